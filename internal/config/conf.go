@@ -23,6 +23,11 @@ func NewConf(filePath string) (*Config, error) {
 		return nil, fmt.Errorf("unknown file extension of file: %v", filePath)
 	}
 	v.SetConfigType(configType)
+	err := v.ReadInConfig()
+	if err != nil {
+		logger.Log().Errorf("failed to read conf: %v, error: %v", filePath, err.Error())
+		return nil, err
+	}
 	c := &Config{}
 
 	options := DecoderConfig(configType)
@@ -41,6 +46,28 @@ func (c *Config) UnmarshalConfig(conf interface{}) error {
 	return nil
 }
 
+// Decode decode the input, such as a nested map of the config, to ptr by the tags of the config
+// type. Fields which are not in the input are kept.
+func (c *Config) Decode(input interface{}, conf interface{}) error {
+	dc := &mapstructure.DecoderConfig{
+		Result:           conf,
+		WeaklyTypedInput: true,
+		ZeroFields:       true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	}
+	for _, option := range c.options {
+		option(dc)
+	}
+	decoder, err := mapstructure.NewDecoder(dc)
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
+
 // DecoderConfig decoder config
 func DecoderConfig(configType string) []viper.DecoderConfigOption {
 	switch configType {
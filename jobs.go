@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/pjoc-team/fsync/internal/config"
+	"github.com/pjoc-team/fsync/pkg/fsync"
+)
+
+// jobs returns the sync jobs of the config, the config itself is the only job if no jobs are
+// defined. Jobs inherit the values which are not set from the config, and keep their states
+// under <confPath>/<name> unless confPath is set.
+func (c *Conf) jobs(cs *config.Config) ([]*Conf, error) {
+	if len(c.Jobs) == 0 {
+		return []*Conf{c}, nil
+	}
+	jobs := make([]*Conf, 0, len(c.Jobs))
+	names := make(map[string]struct{}, len(c.Jobs))
+	for i, values := range c.Jobs {
+		job := *c
+		job.Name = ""
+		job.Jobs = nil
+		err := cs.Decode(values, &job)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job: %v, error: %v", i, err)
+		}
+		if job.Name == "" {
+			return nil, fmt.Errorf("name of job: %v is required", i)
+		}
+		if _, ok := names[job.Name]; ok {
+			return nil, fmt.Errorf("duplicated job: %v", job.Name)
+		}
+		names[job.Name] = struct{}{}
+		if job.ConfPath == c.ConfPath {
+			job.ConfPath = filepath.Join(c.ConfPath, job.Name)
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// newSyncServer create the sync server of the job
+func newSyncServer(
+	ctx context.Context, conf *Conf, limiter *fsync.Limiter,
+) (fsync.SyncServer, error) {
+	storage, err := initServer(conf)
+	if err != nil {
+		return nil, err
+	}
+	return fsync.NewServer(
+		ctx, conf.DataPath, storage, fsync.OptionBufferSize(conf.BlockSize),
+		fsync.OptionConfPath(conf.ConfPath), fsync.OptionThreadPoolSize(threadPoolSize),
+		fsync.OptionStorageName(storageName(conf)),
+		fsync.OptionLimiter(limiter),
+		fsync.OptionRemotePrefix(conf.Prefix),
+		fsync.OptionKeyTemplate(conf.KeyTemplate),
+		fsync.OptionJobName(conf.Name),
+		fsync.OptionInitUpload(conf.InitUpload),
+		fsync.OptionWatchAfterInit(conf.WatchAfterInit),
+		fsync.OptionDeletePolicy(fsync.DeletePolicy(conf.DeletePolicy)),
+		fsync.OptionDeleteDelay(conf.DeleteDelay),
+		fsync.OptionTwoWay(conf.TwoWay),
+		fsync.OptionRemotePollInterval(conf.RemotePollInterval),
+		fsync.OptionConflictPolicy(fsync.ConflictPolicy(conf.ConflictPolicy)),
+		fsync.OptionDebounceWindow(conf.DebounceWindow),
+		fsync.OptionDebounceMaxDelay(conf.DebounceMaxDelay),
+		fsync.OptionQueueSize(conf.QueueSize),
+		fsync.OptionRetryMaxAttempts(conf.RetryMaxAttempts),
+		fsync.OptionRetryBaseDelay(conf.RetryBaseDelay),
+		fsync.OptionRetryMaxDelay(conf.RetryMaxDelay),
+		fsync.OptionReconcileInterval(conf.ReconcileInterval),
+		fsync.OptionIgnorePatterns(conf.Ignore),
+		fsync.OptionIncludePatterns(conf.Include),
+		fsync.OptionWatcherType(fsync.WatcherType(conf.Watcher)),
+		fsync.OptionPollInterval(conf.PollInterval),
+		fsync.OptionAbortUploadsAfter(conf.AbortUploadsAfter),
+	)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/pjoc-team/fsync/internal/config"
 	"github.com/pjoc-team/fsync/pkg/fsync"
 	"github.com/pjoc-team/fsync/pkg/storage/api"
@@ -27,8 +28,23 @@ const (
 	threadPoolSize = 16
 )
 
+const (
+	// modeSync upload and watch the data path
+	modeSync = "sync"
+	// modeRestore download files from the bucket to the data path
+	modeRestore = "restore"
+	// modeDeadLetters print the dead-letter journal
+	modeDeadLetters = "dead-letters"
+	// modeDrainDeadLetters retry the operations in the dead-letter journal
+	modeDrainDeadLetters = "drain-dead-letters"
+	// modeVerify compare the checksums of local files with the bucket
+	modeVerify = "verify"
+)
+
 // Conf config struct
 type Conf struct {
+	// Name name of the job
+	Name       string `yaml:"name" json:"name" xml:"name"`
 	DataPath   string `yaml:"dataPath" json:"data_path" xml:"data_path"`
 	Endpoint   string `yaml:"endpoint" json:"endpoint" xml:"endpoint"`
 	Bucket     string `yaml:"bucket" json:"bucket" xml:"bucket"`
@@ -38,6 +54,58 @@ type Conf struct {
 	BlockSize  int    `yaml:"blockSize" json:"block_size" xml:"block_size"`
 	Debug      bool   `yaml:"debug" json:"debug" xml:"debug"`
 	InitUpload bool   `yaml:"initUpload" json:"init_upload" xml:"init_upload"`
+	// Prefix remote directory of the data path
+	Prefix string `yaml:"prefix" json:"prefix" xml:"prefix"`
+	// KeyTemplate template of remote keys under the prefix
+	KeyTemplate string `yaml:"keyTemplate" json:"key_template" xml:"key_template"`
+	// WatchAfterInit keep watching after the initial upload
+	WatchAfterInit bool `yaml:"watchAfterInit" json:"watch_after_init" xml:"watch_after_init"`
+	// DeletePolicy policy of deletions: never, immediate or delay
+	DeletePolicy string        `yaml:"deletePolicy" json:"delete_policy" xml:"delete_policy"`
+	DeleteDelay  time.Duration `yaml:"deleteDelay" json:"delete_delay" xml:"delete_delay"`
+	// Mode run mode: sync, restore, dead-letters, drain-dead-letters or verify
+	Mode string `yaml:"mode" json:"mode" xml:"mode"`
+	// RestorePrefix remote prefix to restore
+	RestorePrefix string `yaml:"restorePrefix" json:"restore_prefix" xml:"restore_prefix"`
+	// RestorePattern glob pattern of files to restore
+	RestorePattern string `yaml:"restorePattern" json:"restore_pattern" xml:"restore_pattern"`
+	// RestorePolicy policy of existing files: overwrite, skip-identical or skip-existing
+	RestorePolicy string `yaml:"restorePolicy" json:"restore_policy" xml:"restore_policy"`
+	// TwoWay download remote changes besides uploading local changes
+	TwoWay             bool          `yaml:"twoWay" json:"two_way" xml:"two_way"`
+	RemotePollInterval time.Duration `yaml:"remotePollInterval" json:"remote_poll_interval" xml:"remote_poll_interval"`
+	// ConflictPolicy policy of files changed on both sides: newest, local or keep-both
+	ConflictPolicy string `yaml:"conflictPolicy" json:"conflict_policy" xml:"conflict_policy"`
+	// DebounceWindow upload files after they are stable for the window
+	DebounceWindow time.Duration `yaml:"debounceWindow" json:"debounce_window" xml:"debounce_window"`
+	// DebounceMaxDelay upload files which never stop changing after the max delay
+	DebounceMaxDelay time.Duration `yaml:"debounceMaxDelay" json:"debounce_max_delay" xml:"debounce_max_delay"`
+	// QueueSize size of the event queue, watching blocks when the queue is full
+	QueueSize int `yaml:"queueSize" json:"queue_size" xml:"queue_size"`
+	// RetryMaxAttempts attempts of failed uploads and deletions before they are dead-lettered
+	RetryMaxAttempts int           `yaml:"retryMaxAttempts" json:"retry_max_attempts" xml:"retry_max_attempts"`
+	RetryBaseDelay   time.Duration `yaml:"retryBaseDelay" json:"retry_base_delay" xml:"retry_base_delay"`
+	RetryMaxDelay    time.Duration `yaml:"retryMaxDelay" json:"retry_max_delay" xml:"retry_max_delay"`
+	// ReconcileInterval interval of the full reconciliation scan, 0 disables the periodic scan
+	ReconcileInterval time.Duration `yaml:"reconcileInterval" json:"reconcile_interval" xml:"reconcile_interval"`
+	// Watcher watcher of local changes: fsnotify or poll
+	Watcher string `yaml:"watcher" json:"watcher" xml:"watcher"`
+	// PollInterval interval of scanning directories by the poll watcher
+	PollInterval time.Duration `yaml:"pollInterval" json:"poll_interval" xml:"poll_interval"`
+	// AbortUploadsAfter age of incomplete uploads which are aborted, 0 disables the cleanup
+	AbortUploadsAfter time.Duration `yaml:"abortUploadsAfter" json:"abort_uploads_after" xml:"abort_uploads_after"`
+	// UploadConcurrency in-flight parts of an upload
+	UploadConcurrency int `yaml:"uploadConcurrency" json:"upload_concurrency" xml:"upload_concurrency"`
+	// UploadMemory bytes of the buffers of in-flight parts of all uploads of the job
+	UploadMemory int64 `yaml:"uploadMemory" json:"upload_memory" xml:"upload_memory"`
+	// Jobs sync jobs, each job overrides the values above, see Conf.jobs
+	Jobs []map[string]interface{} `yaml:"jobs" json:"jobs" xml:"jobs"`
+	// Ignore gitignore style patterns of files which are not synced
+	Ignore []string `yaml:"ignore" json:"ignore" xml:"ignore"`
+	// Include gitignore style patterns, only matched files are synced if not empty
+	Include []string `yaml:"include" json:"include" xml:"include"`
+	// CheckETag compare the etags of uploads with the md5 of the content
+	CheckETag bool `yaml:"checkETag" json:"check_etag" xml:"check_etag"`
 }
 
 // Conf conf instance
@@ -49,25 +117,151 @@ func init() {
 
 	confVar := "conf"
 	initUploadVar := "init-upload"
+	watchAfterInitVar := "watch-after-init"
 	pathVar := "data-path"
 	confPathVar := "conf-path"
+	prefixVar := "prefix"
+	keyTemplateVar := "key-template"
 	endpointVar := "endpoint"
 	bucketVar := "bucket"
 	secretIDVar := "secret-id"
 	secretKeyVar := "secret-key"
 	blockSizeVar := "block-size"
 	debugVar := "debug"
+	deletePolicyVar := "delete-policy"
+	deleteDelayVar := "delete-delay"
+	modeVar := "mode"
+	restorePrefixVar := "restore-prefix"
+	restorePatternVar := "restore-pattern"
+	restorePolicyVar := "restore-policy"
+	twoWayVar := "two-way"
+	remotePollIntervalVar := "remote-poll-interval"
+	conflictPolicyVar := "conflict-policy"
+	debounceWindowVar := "debounce-window"
+	debounceMaxDelayVar := "debounce-max-delay"
+	queueSizeVar := "queue-size"
+	retryMaxAttemptsVar := "retry-max-attempts"
+	retryBaseDelayVar := "retry-base-delay"
+	retryMaxDelayVar := "retry-max-delay"
+	reconcileIntervalVar := "reconcile-interval"
+	watcherVar := "watcher"
+	pollIntervalVar := "poll-interval"
+	abortUploadsAfterVar := "abort-uploads-after"
+	uploadConcurrencyVar := "upload-concurrency"
+	uploadMemoryVar := "upload-memory"
+	ignoreVar := "ignore"
+	includeVar := "include"
+	checkETagVar := "check-etag"
 
 	pflag.StringVar(&confFile, confVar, "", "conf file path")
 	pflag.BoolVar(&conf.InitUpload, initUploadVar, false, "upload all data when first time")
+	pflag.BoolVar(
+		&conf.WatchAfterInit, watchAfterInitVar, false,
+		"keep watching after the initial upload of init-upload",
+	)
 	pflag.StringVar(&conf.DataPath, pathVar, "./data/", "upload path")
 	pflag.StringVar(&conf.ConfPath, confPathVar, "./conf/", "config path")
+	pflag.StringVar(&conf.Prefix, prefixVar, "/", "remote directory of the data path")
+	pflag.StringVar(
+		&conf.KeyTemplate, keyTemplateVar, "{relpath}",
+		"template of remote keys: {hostname}, {job}, {yyyy}, {mm}, {dd}, {hh} and {relpath}",
+	)
 	pflag.StringVar(&conf.Endpoint, endpointVar, "https://cos.ap-guangzhou.myqcloud.com", "endpoint")
 	pflag.StringVar(&conf.Bucket, bucketVar, "backup-1251070767", "bucket")
 	pflag.StringVar(&conf.SecretID, secretIDVar, "[changeSecretID]", "secretID")
 	pflag.StringVar(&conf.SecretKey, secretKeyVar, "[changeSecretKey]", "secretKey")
-	pflag.IntVar(&conf.BlockSize, blockSizeVar, 1024*1024, "block size")
+	pflag.IntVar(
+		&conf.BlockSize, blockSizeVar, api.MinPartSize,
+		"part size of multipart uploads, at least 5MiB, it grows for files of more than 10000 parts",
+	)
 	pflag.BoolVar(&conf.Debug, debugVar, true, "debug oss")
+	pflag.StringVar(
+		&conf.DeletePolicy, deletePolicyVar, string(fsync.DeletePolicyNever),
+		"policy of propagating local deletions: never, immediate or delay",
+	)
+	pflag.DurationVar(
+		&conf.DeleteDelay, deleteDelayVar, time.Hour, "grace period of the delay delete policy",
+	)
+	pflag.StringVar(
+		&conf.Mode, modeVar, modeSync,
+		"run mode: sync, restore, dead-letters, drain-dead-letters or verify",
+	)
+	pflag.StringVar(&conf.RestorePrefix, restorePrefixVar, "/", "remote prefix to restore")
+	pflag.StringVar(
+		&conf.RestorePattern, restorePatternVar, "",
+		"glob pattern of files to restore, patterns without slash match the file name",
+	)
+	pflag.StringVar(
+		&conf.RestorePolicy, restorePolicyVar, string(fsync.RestorePolicySkipIdentical),
+		"policy of existing files: overwrite, skip-identical or skip-existing",
+	)
+	pflag.BoolVar(&conf.TwoWay, twoWayVar, false, "download remote changes of the bucket")
+	pflag.DurationVar(
+		&conf.RemotePollInterval, remotePollIntervalVar, time.Minute,
+		"interval of polling remote changes in two-way mode",
+	)
+	pflag.StringVar(
+		&conf.ConflictPolicy, conflictPolicyVar, string(fsync.ConflictPolicyNewest),
+		"policy of files changed on both sides: newest, local or keep-both",
+	)
+	pflag.DurationVar(
+		&conf.DebounceWindow, debounceWindowVar, time.Second,
+		"upload files after they are stable for the window, 0 means upload on every event",
+	)
+	pflag.DurationVar(
+		&conf.DebounceMaxDelay, debounceMaxDelayVar, time.Minute,
+		"upload files which never stop changing after the max delay",
+	)
+	pflag.IntVar(
+		&conf.QueueSize, queueSizeVar, 1024,
+		"size of the event queue, watching blocks when the queue is full",
+	)
+	pflag.IntVar(
+		&conf.RetryMaxAttempts, retryMaxAttemptsVar, 5,
+		"attempts of failed uploads and deletions before they are written to the dead-letter journal",
+	)
+	pflag.DurationVar(
+		&conf.RetryBaseDelay, retryBaseDelayVar, time.Second,
+		"delay before the first retry, it doubles on every attempt",
+	)
+	pflag.DurationVar(
+		&conf.RetryMaxDelay, retryMaxDelayVar, 5*time.Minute, "upper bound of the retry delay",
+	)
+	pflag.DurationVar(
+		&conf.ReconcileInterval, reconcileIntervalVar, time.Hour,
+		"interval of the full reconciliation scan, 0 only rescans when events are dropped",
+	)
+	pflag.StringVar(
+		&conf.Watcher, watcherVar, string(fsync.WatcherFsnotify),
+		"watcher of local changes: fsnotify, or poll for NFS, SMB and FUSE mounts",
+	)
+	pflag.DurationVar(
+		&conf.PollInterval, pollIntervalVar, 5*time.Second,
+		"interval of scanning directories by the poll watcher",
+	)
+	pflag.DurationVar(
+		&conf.AbortUploadsAfter, abortUploadsAfterVar, 24*time.Hour,
+		"age of incomplete multipart uploads which are aborted, 0 disables the cleanup",
+	)
+	pflag.IntVar(
+		&conf.UploadConcurrency, uploadConcurrencyVar, 4, "in-flight parts of an upload",
+	)
+	pflag.Int64Var(
+		&conf.UploadMemory, uploadMemoryVar, 64*1024*1024,
+		"bytes of the buffers of in-flight parts of all uploads",
+	)
+	pflag.StringSliceVar(
+		&conf.Ignore, ignoreVar, []string{".git/", "*.swp", "*.swx", "*~"},
+		"gitignore style patterns of files which are not synced, .fsyncignore files are also honoured",
+	)
+	pflag.StringSliceVar(
+		&conf.Include, includeVar, nil,
+		"gitignore style patterns, only matched files are synced if not empty",
+	)
+	pflag.BoolVar(
+		&conf.CheckETag, checkETagVar, true,
+		"compare the etags of uploads with the md5 of the content, disable it if etags aren't md5",
+	)
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
@@ -80,14 +274,41 @@ func init() {
 
 	confFile = viper.GetString(confVar)
 	conf.InitUpload = viper.GetBool(initUploadVar)
+	conf.WatchAfterInit = viper.GetBool(watchAfterInitVar)
 	conf.DataPath = viper.GetString(pathVar)
 	conf.ConfPath = viper.GetString(confPathVar)
+	conf.Prefix = viper.GetString(prefixVar)
+	conf.KeyTemplate = viper.GetString(keyTemplateVar)
 	conf.Endpoint = viper.GetString(endpointVar)
 	conf.Bucket = viper.GetString(bucketVar)
 	conf.SecretID = viper.GetString(secretIDVar)
 	conf.SecretKey = viper.GetString(secretKeyVar)
 	conf.BlockSize = viper.GetInt(blockSizeVar)
 	conf.Debug = viper.GetBool(debugVar)
+	conf.DeletePolicy = viper.GetString(deletePolicyVar)
+	conf.DeleteDelay = viper.GetDuration(deleteDelayVar)
+	conf.Mode = viper.GetString(modeVar)
+	conf.RestorePrefix = viper.GetString(restorePrefixVar)
+	conf.RestorePattern = viper.GetString(restorePatternVar)
+	conf.RestorePolicy = viper.GetString(restorePolicyVar)
+	conf.TwoWay = viper.GetBool(twoWayVar)
+	conf.RemotePollInterval = viper.GetDuration(remotePollIntervalVar)
+	conf.ConflictPolicy = viper.GetString(conflictPolicyVar)
+	conf.DebounceWindow = viper.GetDuration(debounceWindowVar)
+	conf.DebounceMaxDelay = viper.GetDuration(debounceMaxDelayVar)
+	conf.QueueSize = viper.GetInt(queueSizeVar)
+	conf.RetryMaxAttempts = viper.GetInt(retryMaxAttemptsVar)
+	conf.RetryBaseDelay = viper.GetDuration(retryBaseDelayVar)
+	conf.RetryMaxDelay = viper.GetDuration(retryMaxDelayVar)
+	conf.ReconcileInterval = viper.GetDuration(reconcileIntervalVar)
+	conf.Watcher = viper.GetString(watcherVar)
+	conf.PollInterval = viper.GetDuration(pollIntervalVar)
+	conf.AbortUploadsAfter = viper.GetDuration(abortUploadsAfterVar)
+	conf.UploadConcurrency = viper.GetInt(uploadConcurrencyVar)
+	conf.UploadMemory = viper.GetInt64(uploadMemoryVar)
+	conf.Ignore = splitList(viper.GetStringSlice(ignoreVar))
+	conf.Include = splitList(viper.GetStringSlice(includeVar))
+	conf.CheckETag = viper.GetBool(checkETagVar)
 
 	log.Infof("get config: %#v", conf)
 }
@@ -112,36 +333,78 @@ func main() {
 	defer cancelFunc()
 
 	// init
-	conf, err := initConf()
+	jobs, err := initConf()
 	if err != nil {
 		log.Fatalf("failed init file storage server, error: %v", err.Error())
 	}
-	server, err := initServer(conf)
-	if err != nil {
-		log.Fatalf("failed init file storage server, error: %v", err.Error())
+	switch conf.Mode {
+	case modeSync, "":
+	case modeRestore:
+		for _, job := range jobs {
+			err = restore(ctx, job, interrupt)
+			if err != nil {
+				log.Fatalf("failed to restore %v, error: %v", job.DataPath, err.Error())
+			}
+		}
+		return
+	case modeDeadLetters:
+		for _, job := range jobs {
+			err = printDeadLetters(job)
+			if err != nil {
+				log.Fatalf("failed to read dead letters, error: %v", err.Error())
+			}
+		}
+		return
+	case modeDrainDeadLetters:
+		failed := 0
+		for _, job := range jobs {
+			n, err := drainDeadLetters(ctx, job)
+			if err != nil {
+				log.Fatalf("failed to drain dead letters, error: %v", err.Error())
+			}
+			failed += n
+		}
+		if failed > 0 {
+			log.Fatalf("%v operations are failed again and kept in the dead-letter journal", failed)
+		}
+		return
+	case modeVerify:
+		for _, job := range jobs {
+			err = verify(ctx, job)
+			if err != nil {
+				log.Fatalf("failed to verify %v, error: %v", job.DataPath, err.Error())
+			}
+		}
+		return
+	default:
+		log.Fatalf("unknown mode: %v", conf.Mode)
 	}
-	s, err := fsync.NewServer(
-		ctx, conf.DataPath, server, fsync.OptionBufferSize(conf.BlockSize),
-		fsync.OptionConfPath(conf.ConfPath), fsync.OptionThreadPoolSize(threadPoolSize),
-		fsync.OptionInitUpload(conf.InitUpload),
-	)
-	if err != nil {
-		log.Fatalf("failed to create server, error: %v", err.Error())
-	}
-
-	g.Go(
-		func() error {
-			shutdownFunctions = append(
-				shutdownFunctions, func(ctx context.Context) {
-					s.Close()
-				},
-			)
-			err2 := s.Start()
-			log.Infof("fsync server done...")
-			cancelFunc()
-			return err2
-		},
-	)
+
+	// all jobs share the workers and the shutdown
+	limiter := fsync.NewLimiter(threadPoolSize)
+	for _, job := range jobs {
+		s, err := newSyncServer(ctx, job, limiter)
+		if err != nil {
+			log.Fatalf("failed to create server of %v, error: %v", job.DataPath, err.Error())
+		}
+		shutdownFunctions = append(
+			shutdownFunctions, func(ctx context.Context) {
+				s.Close()
+			},
+		)
+		dataPath := job.DataPath
+		g.Go(
+			func() error {
+				err2 := s.Start()
+				log.Infof("fsync server of %v done...", dataPath)
+				return err2
+			},
+		)
+	}
+	go func() {
+		_ = g.Wait()
+		cancelFunc()
+	}()
 
 	select {
 	case <-ctx.Done():
@@ -162,7 +425,9 @@ func main() {
 
 }
 
-func initConf() (*Conf, error) {
+// initConf init the config and returns the sync jobs of it
+func initConf() ([]*Conf, error) {
+	jobs := []*Conf{conf}
 	if confFile != "" {
 		conf = &Conf{}
 		cs, err := config.NewConf(confFile)
@@ -175,7 +440,11 @@ func initConf() (*Conf, error) {
 			logger.Log().Errorf("failed to init conf", err.Error())
 			return nil, err
 		}
-		return conf, nil
+		jobs, err = conf.jobs(cs)
+		if err != nil {
+			logger.Log().Errorf("failed to init jobs, error: %v", err.Error())
+			return nil, err
+		}
 	}
 	level := logger.InfoLevel
 	if conf.Debug {
@@ -189,15 +458,18 @@ func initConf() (*Conf, error) {
 	if err2 != nil {
 		logger.Log().Errorf("failed to init logger", err2.Error())
 	}
-	return conf, nil
+	return jobs, nil
 }
 
 func initServer(conf *Conf) (api.FileStorage, error) {
 	oc := &oss2.Conf{
-		Endpoint:  conf.Endpoint,
-		Bucket:    conf.Bucket,
-		SecretID:  conf.SecretID,
-		SecretKey: conf.SecretKey,
+		Endpoint:      conf.Endpoint,
+		Bucket:        conf.Bucket,
+		SecretID:      conf.SecretID,
+		SecretKey:     conf.SecretKey,
+		Concurrency:   conf.UploadConcurrency,
+		MemoryLimit:   conf.UploadMemory,
+		SkipETagCheck: !conf.CheckETag,
 	}
 	s, err := oss2.NewOssStorage(
 		oc,
@@ -207,3 +479,92 @@ func initServer(conf *Conf) (api.FileStorage, error) {
 
 	return s, err
 }
+
+// storageName returns the name of the storage of the conf, the sync state is kept per storage
+func storageName(conf *Conf) string {
+	return conf.Endpoint + "/" + conf.Bucket
+}
+
+func restore(ctx context.Context, conf *Conf, interrupt chan os.Signal) error {
+	storage, err := initServer(conf)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	go func() {
+		select {
+		case <-interrupt:
+			cancelFunc()
+		case <-ctx.Done():
+		}
+	}()
+	return fsync.Restore(
+		ctx, conf.DataPath, storage, fsync.OptionBufferSize(conf.BlockSize),
+		fsync.OptionConfPath(conf.ConfPath), fsync.OptionThreadPoolSize(threadPoolSize),
+		fsync.OptionRemotePrefix(conf.Prefix),
+		fsync.OptionStorageName(storageName(conf)),
+		fsync.OptionKeyTemplate(conf.KeyTemplate), fsync.OptionJobName(conf.Name),
+		fsync.OptionRestorePrefix(conf.RestorePrefix),
+		fsync.OptionRestorePattern(conf.RestorePattern),
+		fsync.OptionRestorePolicy(fsync.RestorePolicy(conf.RestorePolicy)),
+	)
+}
+
+func drainDeadLetters(ctx context.Context, conf *Conf) (int, error) {
+	storage, err := initServer(conf)
+	if err != nil {
+		return 0, err
+	}
+	return fsync.DrainDeadLetters(
+		ctx, conf.DataPath, storage, fsync.OptionBufferSize(conf.BlockSize),
+		fsync.OptionConfPath(conf.ConfPath), fsync.OptionRemotePrefix(conf.Prefix),
+		fsync.OptionStorageName(storageName(conf)),
+		fsync.OptionKeyTemplate(conf.KeyTemplate), fsync.OptionJobName(conf.Name),
+		fsync.OptionTwoWay(conf.TwoWay),
+		fsync.OptionConflictPolicy(fsync.ConflictPolicy(conf.ConflictPolicy)),
+	)
+}
+
+func verify(ctx context.Context, conf *Conf) error {
+	storage, err := initServer(conf)
+	if err != nil {
+		return err
+	}
+	return fsync.Verify(
+		ctx, conf.DataPath, storage, fsync.OptionBufferSize(conf.BlockSize),
+		fsync.OptionConfPath(conf.ConfPath), fsync.OptionThreadPoolSize(threadPoolSize),
+		fsync.OptionRemotePrefix(conf.Prefix),
+		fsync.OptionStorageName(storageName(conf)),
+		fsync.OptionKeyTemplate(conf.KeyTemplate), fsync.OptionJobName(conf.Name),
+		fsync.OptionIgnorePatterns(conf.Ignore), fsync.OptionIncludePatterns(conf.Include),
+	)
+}
+
+// splitList split comma separated values, env values are not split by viper
+func splitList(values []string) []string {
+	list := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+	}
+	return list
+}
+
+// printDeadLetters print the dead-letter journal of the job to stdout
+func printDeadLetters(conf *Conf) error {
+	letters, err := fsync.DeadLetters(conf.ConfPath)
+	if err != nil {
+		return err
+	}
+	for _, d := range letters {
+		fmt.Printf(
+			"%v\t%v\t%v\tattempts: %v\terror: %v\n", d.Time.Format(time.RFC3339), d.Op, d.Path,
+			d.Attempts, d.Error,
+		)
+	}
+	return nil
+}
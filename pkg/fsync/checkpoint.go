@@ -0,0 +1,138 @@
+package fsync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+)
+
+const (
+	// checkpointFile file name of the checkpoint store under the ConfPath
+	checkpointFile = "fsync-checkpoints.json"
+)
+
+// checkpointStore checkpoints of incomplete uploads keyed by the path in storage, it's kept in
+// memory and flushed to the file with the state store, so uploads interrupted by failures or
+// restarts are resumed.
+type checkpointStore struct {
+	path        string
+	mutex       sync.Mutex
+	checkpoints map[string]*api.Checkpoint
+	dirty       bool
+}
+
+// openCheckpointStore open the checkpoint store of the file, the store is memory only if path
+// is empty
+func openCheckpointStore(path string) (*checkpointStore, error) {
+	s := &checkpointStore{
+		path:        path,
+		checkpoints: make(map[string]*api.Checkpoint),
+	}
+	if path == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get get the checkpoint of the path, returns nil if there is no incomplete upload
+func (s *checkpointStore) Get(path string) *api.Checkpoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.checkpoints[path]
+}
+
+// Put save the checkpoint of the path
+func (s *checkpointStore) Put(path string, checkpoint *api.Checkpoint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkpoints[path] = checkpoint
+	s.dirty = true
+}
+
+// Delete delete the checkpoint of the path
+func (s *checkpointStore) Delete(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.checkpoints[path]; ok {
+		delete(s.checkpoints, path)
+		s.dirty = true
+	}
+}
+
+// Has returns true if the upload of the path is held by a checkpoint
+func (s *checkpointStore) Has(path, uploadID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	checkpoint, ok := s.checkpoints[path]
+	return ok && checkpoint.UploadID == uploadID
+}
+
+// Remove delete the checkpoints of the paths matched by fn, returns the removed checkpoints
+// keyed by the path
+func (s *checkpointStore) Remove(fn func(path string) bool) map[string]*api.Checkpoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := make(map[string]*api.Checkpoint)
+	for path, checkpoint := range s.checkpoints {
+		if fn(path) {
+			removed[path] = checkpoint
+			delete(s.checkpoints, path)
+			s.dirty = true
+		}
+	}
+	return removed
+}
+
+// Flush write the checkpoints to the file if changed
+func (s *checkpointStore) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.checkpoints)
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.path, data)
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// checkpointFilePath returns the path of the checkpoint file under the conf path, the store is
+// memory only if conf path is empty
+func checkpointFilePath(confPath string) string {
+	if confPath == "" {
+		return ""
+	}
+	return filepath.Join(confPath, checkpointFile)
+}
@@ -0,0 +1,137 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+func Test_checkpointStore_Flush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-checkpoint")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := checkpointFilePath(dir)
+	s, err := openCheckpointStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	part := api.CheckpointPart{Number: 1, Size: 5, MD5: "m1", ETag: "e1"}
+	s.Put("/a.txt", &api.Checkpoint{UploadID: "u1", PartSize: 5, Parts: []api.CheckpointPart{part}})
+	s.Put("/b.txt", &api.Checkpoint{UploadID: "u2", PartSize: 5})
+	s.Delete("/b.txt")
+	err = s.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s2, err := openCheckpointStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := s2.Get("/a.txt")
+	if got == nil || got.UploadID != "u1" || len(got.Parts) != 1 || got.Parts[0] != part {
+		t.Errorf("Get() = %+v, want upload u1 with part %+v", got, part)
+	}
+	if got := s2.Get("/b.txt"); got != nil {
+		t.Errorf("Get() of deleted checkpoint = %+v, want nil", got)
+	}
+}
+
+// checkpointStorage storage which records the uploads of the aborted checkpoints
+type checkpointStorage struct {
+	*memory.Storage
+	mutex   sync.Mutex
+	aborted []string
+}
+
+func (c *checkpointStorage) AbortCheckpoint(
+	ctx context.Context, path string, checkpoint *api.Checkpoint,
+) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.aborted = append(c.aborted, checkpoint.UploadID)
+	sort.Strings(c.aborted)
+	return nil
+}
+
+func (c *checkpointStorage) Aborted() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	aborted := c.aborted
+	c.aborted = nil
+	return aborted
+}
+
+func Test_server_dropFileCheckpoints(t *testing.T) {
+	storage := &checkpointStorage{Storage: memory.NewMemoryFileStorage()}
+	dir := tempDir(t)
+	s, _ := newTestServer(
+		t, dir, storage, OptionRemotePrefix("backup"), OptionKeyTemplate("{yyyy}/{relpath}"),
+	)
+	checkpoints := map[string]string{
+		"/backup/2020/a.txt":     "a1",
+		"/backup/2021/a.txt":     "a2",
+		"/backup/2021/a.txt.bak": "a3",
+		"/backup/2021/d/b.txt":   "b",
+		"/backup/2021/d/e/c.txt": "c",
+		"/backup/2021/dd/d.txt":  "d",
+	}
+	for path, id := range checkpoints {
+		s.checkpoints.Put(path, &api.Checkpoint{UploadID: id, PartSize: 5})
+	}
+
+	tests := []struct {
+		name  string
+		drop  func()
+		want  []string
+		wantN int
+	}{
+		{
+			name: "file of all keys",
+			drop: func() {
+				s.dropFileCheckpoints(filepath.Join(dir, "a.txt"), false)
+			},
+			want: []string{"a1", "a2"}, wantN: 4,
+		},
+		{
+			name: "directory",
+			drop: func() {
+				s.dropFileCheckpoints(filepath.Join(dir, "d"), true)
+			},
+			want: []string{"b", "c"}, wantN: 2,
+		},
+		{
+			name: "dead letter",
+			drop: func() {
+				file := filepath.Join(dir, "dd", "d.txt")
+				s.deadLetter(&operation{op: opUpload, file: file}, errors.New("failed"))
+			},
+			want: []string{"d"}, wantN: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				tt.drop()
+				if got := storage.Aborted(); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("aborted uploads = %v, want %v", got, tt.want)
+				}
+				if left := len(s.checkpoints.checkpoints); left != tt.wantN {
+					t.Errorf("checkpoints left = %v, want %v", left, tt.wantN)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,287 @@
+package fsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// deadLetterFile file name of the dead-letter journal under the conf path
+	deadLetterFile = "fsync-dead-letter.jsonl"
+)
+
+// DeadLetter operation which is failed after all attempts
+type DeadLetter struct {
+	// Op operation: upload or delete
+	Op string `json:"op"`
+	// Path local path of the file
+	Path     string    `json:"path"`
+	IsDir    bool      `json:"is_dir,omitempty"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// deadLetterJournal journal of dead letters, one json object per line. A letter is appended when
+// an operation is failed, and removed when the operation succeeds.
+type deadLetterJournal struct {
+	path  string
+	mutex sync.Mutex
+	// pending operations in the journal keyed by letterKey, nil until the journal is read
+	pending map[string]struct{}
+}
+
+// openDeadLetterJournal returns nil if the conf path is empty
+func openDeadLetterJournal(confPath string) (*deadLetterJournal, error) {
+	if confPath == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(confPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterJournal{path: filepath.Join(confPath, deadLetterFile)}, nil
+}
+
+// letterKey returns the key of the operation on the path
+func letterKey(op string, path string) string {
+	return op + ":" + path
+}
+
+// Append write the dead letter to the journal and sync it to the disk, the letter of the same
+// operation on the path is replaced
+func (j *deadLetterJournal) Append(d *DeadLetter) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	err := j.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := j.pending[letterKey(d.Op, d.Path)]; ok {
+		return j.rewrite(d.Op, d.Path, d)
+	}
+	data, err := appendLine(nil, d)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	j.pending[letterKey(d.Op, d.Path)] = struct{}{}
+	return nil
+}
+
+// List returns all dead letters in the journal
+func (j *deadLetterJournal) List() ([]*DeadLetter, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.read()
+}
+
+// Remove remove the dead letter of the operation on the path, it's a no-op if the operation is
+// not in the journal
+func (j *deadLetterJournal) Remove(op string, path string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	err := j.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := j.pending[letterKey(op, path)]; !ok {
+		return nil
+	}
+	return j.rewrite(op, path, nil)
+}
+
+// load read the pending operations of the journal once
+func (j *deadLetterJournal) load() error {
+	if j.pending != nil {
+		return nil
+	}
+	letters, err := j.read()
+	if err != nil {
+		return err
+	}
+	j.pending = make(map[string]struct{}, len(letters))
+	for _, d := range letters {
+		j.pending[letterKey(d.Op, d.Path)] = struct{}{}
+	}
+	return nil
+}
+
+// rewrite drop the letters of the operation on the path and append the dead letter if it's not
+// nil, the journal is replaced atomically
+func (j *deadLetterJournal) rewrite(op string, path string, d *DeadLetter) error {
+	letters, err := j.read()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0)
+	for _, letter := range letters {
+		if letter.Op == op && letter.Path == path {
+			continue
+		}
+		if data, err = appendLine(data, letter); err != nil {
+			return err
+		}
+	}
+	if d != nil {
+		if data, err = appendLine(data, d); err != nil {
+			return err
+		}
+	}
+	err = writeFileAtomic(j.path, data)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		delete(j.pending, letterKey(op, path))
+	}
+	return nil
+}
+
+// appendLine append the json line of the dead letter to the data
+func appendLine(data []byte, d *DeadLetter) ([]byte, error) {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return data, err
+	}
+	return append(append(data, line...), '\n'), nil
+}
+
+func (j *deadLetterJournal) read() ([]*DeadLetter, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	letters := make([]*DeadLetter, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		d := &DeadLetter{}
+		err = json.Unmarshal(line, d)
+		if err != nil {
+			// a torn line of a crash
+			continue
+		}
+		letters = append(letters, d)
+	}
+	return letters, scanner.Err()
+}
+
+// replayDeadLetters resubmit the dead letters of the last run, they are kept in the journal
+// until the operations succeed or are dead-lettered again
+func (s *server) replayDeadLetters() {
+	if s.deadLetters == nil {
+		return
+	}
+	log := logger.ContextLog(s.ctx)
+	letters, err := s.deadLetters.List()
+	if err != nil {
+		log.Errorf("failed to read dead letters, error: %v", err.Error())
+		return
+	}
+	for _, d := range letters {
+		log.Infof("replay %v of file: %v", d.Op, d.Path)
+		s.submitOperation(
+			&operation{op: d.Op, file: d.Path, isDir: d.IsDir, attempt: 1},
+		)
+	}
+}
+
+// DeadLetters returns the operations in the dead-letter journal under the conf path
+func DeadLetters(confPath string) ([]*DeadLetter, error) {
+	if confPath == "" {
+		return nil, nil
+	}
+	j := &deadLetterJournal{path: filepath.Join(confPath, deadLetterFile)}
+	return j.List()
+}
+
+// DrainDeadLetters retry the operations in the dead-letter journal once, operations are removed
+// from the journal after they succeed, and those failed again are kept in it. Returns the number
+// of failed operations.
+func DrainDeadLetters(
+	ctx context.Context, rootPath string, storage api.FileStorage, opts ...Option,
+) (int, error) {
+	log := logger.ContextLog(ctx)
+	o, err := newFoptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	err = o.validate()
+	if err != nil {
+		return 0, err
+	}
+	if o.ConfPath == "" {
+		return 0, errors.New("conf path is required to drain dead letters")
+	}
+	s, err := newServer(ctx, rootPath, storage, &o)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	letters, err := s.deadLetters.List()
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, d := range letters {
+		op := &operation{op: d.Op, file: d.Path, isDir: d.IsDir, attempt: d.Attempts + 1}
+		if s.obsolete(op) {
+			log.Infof("drop %v of file: %v", d.Op, d.Path)
+			s.dropObsolete(op)
+			continue
+		}
+		err = s.doOperation(op)
+		if err == nil {
+			log.Infof("drained %v of file: %v", d.Op, d.Path)
+			s.settle(op)
+			continue
+		}
+		if s.obsolete(op) {
+			log.Infof("drop %v of file: %v", d.Op, d.Path)
+			s.dropObsolete(op)
+			continue
+		}
+		if ctx.Err() != nil {
+			// the letter is kept in the journal
+			return failed, ctx.Err()
+		}
+		log.Errorf("failed to %v file: %v, error: %v", d.Op, d.Path, err.Error())
+		failed++
+		s.deadLetter(op, err)
+	}
+	return failed, s.state.Flush()
+}
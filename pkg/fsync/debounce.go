@@ -0,0 +1,144 @@
+package fsync
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// debouncer delays the handling of file events until the file is stable, which means no events
+// are received and the size and mtime are unchanged during the window. Files are handled at
+// latest maxDelay after the first event if maxDelay is positive.
+type debouncer struct {
+	window   time.Duration
+	maxDelay time.Duration
+	fn       func(file string)
+	mutex    sync.Mutex
+	pending  map[string]*pendingFile
+	clock    clock
+}
+
+// clock source of the time and timers, it's replaced in tests
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer timer of the clock which calls the function in its own goroutine
+type timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// pendingFile file waiting to be stable
+type pendingFile struct {
+	first   time.Time
+	last    time.Time
+	size    int64
+	modTime time.Time
+	timer   timer
+}
+
+func newDebouncer(window time.Duration, maxDelay time.Duration, fn func(file string)) *debouncer {
+	return &debouncer{
+		window:   window,
+		maxDelay: maxDelay,
+		fn:       fn,
+		pending:  make(map[string]*pendingFile),
+		clock:    realClock{},
+	}
+}
+
+// Touch record an event of the file, fn is called directly if the window is not positive
+func (d *debouncer) Touch(file string) {
+	if d.window <= 0 {
+		d.fn(file)
+		return
+	}
+	now := d.clock.Now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	p, ok := d.pending[file]
+	if !ok {
+		p = &pendingFile{first: now}
+		p.timer = d.clock.AfterFunc(
+			d.window, func() {
+				d.check(file)
+			},
+		)
+		d.pending[file] = p
+	}
+	p.last = now
+	if stat, err := os.Stat(file); err == nil {
+		p.size = stat.Size()
+		p.modTime = stat.ModTime()
+	}
+}
+
+// Cancel drop the pending file, it's called when the file is removed or renamed
+func (d *debouncer) Cancel(file string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if p, ok := d.pending[file]; ok {
+		p.timer.Stop()
+		delete(d.pending, file)
+	}
+}
+
+// Stop drop all pending files
+func (d *debouncer) Stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for file, p := range d.pending {
+		p.timer.Stop()
+		delete(d.pending, file)
+	}
+}
+
+func (d *debouncer) check(file string) {
+	d.mutex.Lock()
+	p, ok := d.pending[file]
+	if !ok {
+		d.mutex.Unlock()
+		return
+	}
+	now := d.clock.Now()
+	stat, err := os.Stat(file)
+	if err != nil {
+		// removed files are handled by the remove events
+		delete(d.pending, file)
+		d.mutex.Unlock()
+		return
+	}
+	quiet := now.Sub(p.last)
+	stable := stat.IsDir() ||
+		(quiet >= d.window && stat.Size() == p.size && stat.ModTime().Equal(p.modTime))
+	if stable || (d.maxDelay > 0 && now.Sub(p.first) >= d.maxDelay) {
+		delete(d.pending, file)
+		d.mutex.Unlock()
+		d.fn(file)
+		return
+	}
+
+	wait := d.window - quiet
+	if wait <= 0 {
+		// changed without events, wait for another window
+		p.last = now
+		wait = d.window
+	}
+	p.size = stat.Size()
+	p.modTime = stat.ModTime()
+	p.timer.Reset(wait)
+	d.mutex.Unlock()
+}
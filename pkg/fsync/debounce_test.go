@@ -0,0 +1,136 @@
+package fsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock clock which is advanced by tests, timers are fired by Advance in order
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance move the clock forward and fire the expired timers in the goroutine of the caller
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.active = false
+		c.now = next.at
+		c.mutex.Unlock()
+		next.f()
+		c.mutex.Lock()
+	}
+	c.now = end
+	c.mutex.Unlock()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.at = t.clock.now.Add(d)
+	t.active = true
+	return active
+}
+
+func Test_debouncer_Touch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-debounce")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		window   time.Duration
+		maxDelay time.Duration
+		writes   int
+		want     int64
+	}{
+		{name: "no window", window: 0, writes: 5, want: 5},
+		{name: "coalesce writes", window: 50 * time.Millisecond, writes: 10, want: 1},
+		{
+			name: "max delay", window: 50 * time.Millisecond, maxDelay: 100 * time.Millisecond,
+			writes: 20, want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name)
+			var count int64
+			d := newDebouncer(tt.window, tt.maxDelay, func(string) {
+				atomic.AddInt64(&count, 1)
+			})
+			clock := newFakeClock()
+			d.clock = clock
+			defer d.Stop()
+			f, err := os.Create(file)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer f.Close()
+			for i := 0; i < tt.writes; i++ {
+				_, err = f.WriteString("data")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				d.Touch(file)
+				clock.Advance(10 * time.Millisecond)
+			}
+			clock.Advance(3 * tt.window)
+			if got := atomic.LoadInt64(&count); got != tt.want {
+				t.Errorf("uploads = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package fsync
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+// DeletePolicy policy of propagating local deletions to the storage
+type DeletePolicy string
+
+const (
+	// DeletePolicyNever never delete files in storage
+	DeletePolicyNever DeletePolicy = "never"
+	// DeletePolicyImmediate delete files in storage as soon as they are removed locally
+	DeletePolicyImmediate DeletePolicy = "immediate"
+	// DeletePolicyDelay delete files in storage after the DeleteDelay grace period,
+	// the deletion is canceled if the file is created again during the period
+	DeletePolicyDelay DeletePolicy = "delay"
+)
+
+// ParseDeletePolicy parse delete policy, empty string means DeletePolicyNever
+func ParseDeletePolicy(policy string) (DeletePolicy, error) {
+	switch p := DeletePolicy(policy); p {
+	case "":
+		return DeletePolicyNever, nil
+	case DeletePolicyNever, DeletePolicyImmediate, DeletePolicyDelay:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown delete policy: %v", policy)
+}
+
+// removeFile handle the removal of the local file or directory
+func (s *server) removeFile(file string, isDir bool) {
+	log := logger.ContextLog(s.ctx)
+	if isDir {
+		s.state.DeleteDir(s.statePath(file))
+	} else {
+		s.state.Delete(s.statePath(file))
+	}
+	switch s.options.DeletePolicy {
+	case DeletePolicyImmediate:
+		s.submitDelete(file, isDir)
+	case DeletePolicyDelay:
+		log.Infof("delete file: %v after %v", file, s.options.DeleteDelay)
+		s.deleteMutex.Lock()
+		defer s.deleteMutex.Unlock()
+		if _, ok := s.pendingDeletes[file]; ok {
+			// keep the grace period of the first removal
+			return
+		}
+		s.pendingDeletes[file] = time.AfterFunc(
+			s.options.DeleteDelay, func() {
+				s.deleteMutex.Lock()
+				delete(s.pendingDeletes, file)
+				s.deleteMutex.Unlock()
+				s.submitDelete(file, isDir)
+			},
+		)
+	default:
+		log.Debugf("skip delete file: %v of policy: %v", file, s.options.DeletePolicy)
+	}
+}
+
+// cancelDelete cancel the pending deletion of the file which is created again
+func (s *server) cancelDelete(file string) {
+	s.deleteMutex.Lock()
+	defer s.deleteMutex.Unlock()
+	if timer, ok := s.pendingDeletes[file]; ok {
+		timer.Stop()
+		delete(s.pendingDeletes, file)
+		logger.ContextLog(s.ctx).Infof("cancel deletion of file: %v", file)
+	}
+}
+
+// stopDeletes stop all pending deletions
+func (s *server) stopDeletes() {
+	s.deleteMutex.Lock()
+	defer s.deleteMutex.Unlock()
+	for file, timer := range s.pendingDeletes {
+		timer.Stop()
+		delete(s.pendingDeletes, file)
+	}
+}
+
+// submitDelete submit the deletion of the remote file to the pipeline
+func (s *server) submitDelete(file string, isDir bool) {
+	s.submitOperation(&operation{op: opDelete, file: file, isDir: isDir, attempt: 1})
+}
+
+func (s *server) deleteRemote(file string, isDir bool) error {
+	log := logger.ContextLog(s.ctx)
+	s.dropFileCheckpoints(file, isDir)
+	if s.keys.dynamic {
+		return s.deleteKeys(file, isDir)
+	}
+	path := s.remotePath(file)
+	if isDir {
+		log.Infof("delete dir: %v", path)
+		return s.storage.DeleteAll(s.ctx, path)
+	}
+	log.Infof("delete file: %v", path)
+	return s.storage.Delete(s.ctx, path)
+}
+
+// deleteKeys delete all remote files of the local file or directory, which may be uploaded to
+// several keys if the key template contains time variables
+func (s *server) deleteKeys(file string, isDir bool) error {
+	log := logger.ContextLog(s.ctx)
+	rel := s.statePath(file)
+	keys := make([]string, 0)
+	err := api.Walk(
+		s.ctx, s.storage, s.keys.root, func(info *api.FileInfo) error {
+			r, ok := s.keys.rel(info.Path)
+			if ok && (r == rel || isDir && strings.HasPrefix(r, rel+"/")) {
+				keys = append(keys, info.Path)
+			}
+			return s.ctx.Err()
+		},
+	)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		log.Infof("delete file: %v", key)
+		err = s.storage.Delete(s.ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
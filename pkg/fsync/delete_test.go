@@ -0,0 +1,90 @@
+package fsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+func Test_server_removeFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   DeletePolicy
+		delay    time.Duration
+		recreate bool
+		deleted  bool
+	}{
+		{name: "never", policy: DeletePolicyNever},
+		{name: "immediate", policy: DeletePolicyImmediate, deleted: true},
+		{name: "delay", policy: DeletePolicyDelay, delay: 10 * time.Millisecond, deleted: true},
+		{name: "cancel on recreate", policy: DeletePolicyDelay, delay: time.Hour, recreate: true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				local := tempDir(t)
+				remote := memory.NewMemoryFileStorage()
+				s, watcher := newTestServer(
+					t, local, remote, OptionDebounceWindow(0), OptionDeletePolicy(tt.policy),
+					OptionDeleteDelay(tt.delay),
+				)
+				go s.watchFile()
+				// settle wait until the event loop handled the previous event and the submitted
+				// operations are done, events of the root path are skipped
+				settle := func() {
+					watcher.events <- fsnotify.Event{Name: local, Op: fsnotify.Write}
+					s.pipeline.Wait()
+				}
+
+				file := filepath.Join(local, "a.txt")
+				err := ioutil.WriteFile(file, []byte("a"), 0644)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Create}
+				eventually(
+					t, "file is uploaded", func() bool {
+						_, ok := remoteData(remote, "/a.txt")
+						return ok
+					},
+				)
+
+				err = os.Remove(file)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Remove}
+				settle()
+				if tt.recreate {
+					err = ioutil.WriteFile(file, []byte("b"), 0644)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Create}
+					settle()
+					s.deleteMutex.Lock()
+					pending := len(s.pendingDeletes)
+					s.deleteMutex.Unlock()
+					if pending != 0 {
+						t.Errorf("pending deletions = %v, want 0", pending)
+					}
+				}
+				if tt.deleted {
+					eventually(
+						t, "remote file is deleted", func() bool {
+							_, ok := remoteData(remote, "/a.txt")
+							return !ok
+						},
+					)
+				} else if _, ok := remoteData(remote, "/a.txt"); !ok {
+					t.Errorf("remote file is deleted by policy: %v", tt.policy)
+				}
+			},
+		)
+	}
+}
@@ -2,6 +2,8 @@ package fsync
 
 // Code generated by github.com/launchdarkly/go-options.  DO NOT EDIT.
 
+import "time"
+
 type ApplyOptionFunc func(c *foptions) error
 
 func (f ApplyOptionFunc) apply(c *foptions) error {
@@ -54,3 +56,192 @@ func OptionThreadPoolSize(o int) ApplyOptionFunc {
 		return nil
 	}
 }
+
+func OptionDeletePolicy(o DeletePolicy) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.DeletePolicy = o
+		return nil
+	}
+}
+
+func OptionDeleteDelay(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.DeleteDelay = o
+		return nil
+	}
+}
+
+func OptionRestorePrefix(o string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RestorePrefix = o
+		return nil
+	}
+}
+
+func OptionRestorePattern(o string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RestorePattern = o
+		return nil
+	}
+}
+
+func OptionRestorePolicy(o RestorePolicy) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RestorePolicy = o
+		return nil
+	}
+}
+
+func OptionTwoWay(o bool) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.TwoWay = o
+		return nil
+	}
+}
+
+func OptionRemotePollInterval(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RemotePollInterval = o
+		return nil
+	}
+}
+
+func OptionConflictPolicy(o ConflictPolicy) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.ConflictPolicy = o
+		return nil
+	}
+}
+
+func OptionDebounceWindow(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.DebounceWindow = o
+		return nil
+	}
+}
+
+func OptionDebounceMaxDelay(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.DebounceMaxDelay = o
+		return nil
+	}
+}
+
+func OptionQueueSize(o int) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.QueueSize = o
+		return nil
+	}
+}
+
+func OptionRetryMaxAttempts(o int) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RetryMaxAttempts = o
+		return nil
+	}
+}
+
+func OptionRetryBaseDelay(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RetryBaseDelay = o
+		return nil
+	}
+}
+
+func OptionRetryMaxDelay(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RetryMaxDelay = o
+		return nil
+	}
+}
+
+func OptionIgnorePatterns(o []string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.IgnorePatterns = o
+		return nil
+	}
+}
+
+func OptionIncludePatterns(o []string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.IncludePatterns = o
+		return nil
+	}
+}
+
+func OptionReconcileInterval(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.ReconcileInterval = o
+		return nil
+	}
+}
+
+func OptionWatcherType(o WatcherType) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.WatcherType = o
+		return nil
+	}
+}
+
+func OptionPollInterval(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.PollInterval = o
+		return nil
+	}
+}
+
+func OptionWatcher(o Watcher) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.Watcher = o
+		return nil
+	}
+}
+
+func OptionWatchAfterInit(o bool) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.WatchAfterInit = o
+		return nil
+	}
+}
+
+func OptionRemotePrefix(o string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.RemotePrefix = o
+		return nil
+	}
+}
+
+func OptionLimiter(o *Limiter) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.Limiter = o
+		return nil
+	}
+}
+
+func OptionKeyTemplate(o string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.KeyTemplate = o
+		return nil
+	}
+}
+
+func OptionJobName(o string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.JobName = o
+		return nil
+	}
+}
+
+func OptionAbortUploadsAfter(o time.Duration) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.AbortUploadsAfter = o
+		return nil
+	}
+}
+
+func OptionStorageName(o string) ApplyOptionFunc {
+	return func(c *foptions) error {
+		c.StorageName = o
+		return nil
+	}
+}
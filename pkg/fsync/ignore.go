@@ -0,0 +1,202 @@
+package fsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// ignoreFile file name of the per-directory ignore rules
+	ignoreFile = ".fsyncignore"
+)
+
+// ignoreRule gitignore style pattern
+type ignoreRule struct {
+	// base slash separated directory of the rule relative to the root path, patterns are
+	// matched against paths relative to the base
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns contain a slash and match the whole relative path, other patterns
+	// match the file name at any depth
+	anchored bool
+}
+
+// parseIgnoreRules parse gitignore style lines: blank lines and lines starting with # are
+// skipped, ! negates the pattern, a trailing slash matches directories only, and ** matches any
+// number of directories.
+func parseIgnoreRules(base string, lines []string) []*ignoreRule {
+	rules := make([]*ignoreRule, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := &ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// escaped leading # or !
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.segments = strings.Split(line, "/")
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// match returns true if the slash separated path relative to the root path matches the rule
+func (r *ignoreRule) match(p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(p, r.base+"/") {
+			return false
+		}
+		p = p[len(r.base)+1:]
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(p))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(p, "/"))
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// a trailing ** matches everything inside, but not the directory itself
+				return len(segments) > 0
+			}
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], segments[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// matchRules returns true if the last matched rule is not negated
+func matchRules(rules []*ignoreRule, p string, isDir bool) bool {
+	matched := false
+	for _, r := range rules {
+		if r.match(p, isDir) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+// ignorer matches paths against the rules of options and .fsyncignore files. Rules of deeper
+// .fsyncignore files take precedence, and files in an ignored directory are always ignored.
+type ignorer struct {
+	rootPath string
+	exclude  []*ignoreRule
+	// include files are synced only if they match the include rules, directories are not
+	// affected
+	include []*ignoreRule
+	mutex   sync.Mutex
+	// dirs cached rules of .fsyncignore files by directory
+	dirs map[string][]*ignoreRule
+}
+
+func newIgnorer(rootPath string, ignore []string, include []string) *ignorer {
+	return &ignorer{
+		rootPath: rootPath,
+		exclude:  parseIgnoreRules("", ignore),
+		include:  parseIgnoreRules("", include),
+		dirs:     make(map[string][]*ignoreRule),
+	}
+}
+
+// Ignored returns true if the slash separated path relative to the root path is ignored
+func (i *ignorer) Ignored(p string, isDir bool) bool {
+	if p == "" || p == "." {
+		return false
+	}
+	segments := strings.Split(p, "/")
+	for n := 1; n < len(segments); n++ {
+		if i.excluded(segments[:n], true) {
+			return true
+		}
+	}
+	if i.excluded(segments, isDir) {
+		return true
+	}
+	return !isDir && len(i.include) > 0 && !matchRules(i.include, p, false)
+}
+
+func (i *ignorer) excluded(segments []string, isDir bool) bool {
+	rules := i.exclude
+	for n := 0; n < len(segments); n++ {
+		rules = append(rules[:len(rules):len(rules)], i.rules(path.Join(segments[:n]...))...)
+	}
+	return matchRules(rules, strings.Join(segments, "/"), isDir)
+}
+
+// rules returns the rules of the .fsyncignore file in the directory
+func (i *ignorer) rules(dir string) []*ignoreRule {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	rules, ok := i.dirs[dir]
+	if ok {
+		return rules
+	}
+	data, err := ioutil.ReadFile(filepath.Join(i.rootPath, filepath.FromSlash(dir), ignoreFile))
+	if err == nil {
+		rules = parseIgnoreRules(dir, strings.Split(string(data), "\n"))
+	}
+	i.dirs[dir] = rules
+	return rules
+}
+
+// Reload drop the cached rules of the directory, it's called when the .fsyncignore file is
+// changed. Directories which are already watched or skipped are not affected.
+func (i *ignorer) Reload(dir string) {
+	if dir == "." {
+		// rules of the root path are cached by path.Join() of no segments
+		dir = ""
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.dirs, dir)
+}
+
+// syncable returns false if the file is not a regular file, directory or symbolic link, such as
+// sockets and named pipes
+func syncable(stat os.FileInfo) bool {
+	mode := stat.Mode()
+	return mode.IsRegular() || mode.IsDir() || mode&os.ModeSymlink != 0
+}
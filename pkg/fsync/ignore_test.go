@@ -0,0 +1,108 @@
+package fsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ignorer_Ignored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-ignore")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "logs"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "logs", ignoreFile), []byte("# logs\n*.log\n!keep.log\n/tmp/\n"), 0644,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	i := newIgnorer(dir, []string{".git/", "*.swp", "/build/**", "docs/**/draft"}, nil)
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{path: "a.txt", want: false},
+		{path: ".git", isDir: true, want: true},
+		{path: "src/.git", isDir: true, want: true},
+		{path: "src/.git/HEAD", want: true},
+		{path: ".git", want: false},
+		{path: "src/.main.go.swp", want: true},
+		{path: "build", isDir: true, want: false},
+		{path: "build/out/bin", want: true},
+		{path: "src/build/bin", want: false},
+		{path: "docs/draft", want: true},
+		{path: "docs/a/b/draft", want: true},
+		{path: "app.log", want: false},
+		{path: "logs/app.log", want: true},
+		{path: "logs/2021/app.log", want: true},
+		{path: "logs/keep.log", want: false},
+		{path: "logs/tmp", isDir: true, want: true},
+		{path: "logs/a/tmp", isDir: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := i.Ignored(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Ignored(%v, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+
+	include := newIgnorer(dir, nil, []string{"*.jpg"})
+	if include.Ignored("photos", true) {
+		t.Errorf("directories should not be filtered by include patterns")
+	}
+	if include.Ignored("photos/a.jpg", false) || !include.Ignored("photos/a.txt", false) {
+		t.Errorf("only included files should be synced")
+	}
+}
+
+func Test_ignorer_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-ignore")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "logs"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	i := newIgnorer(dir, nil, nil)
+	for _, file := range []string{ignoreFile, "logs/" + ignoreFile} {
+		t.Run(
+			file, func(t *testing.T) {
+				name := filepath.Join(dir, filepath.FromSlash(file))
+				err := ioutil.WriteFile(name, []byte("*.tmp\n"), 0644)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				i.Reload(path.Dir(file))
+				if !i.Ignored("logs/a.tmp", false) || i.Ignored("logs/a.bak", false) {
+					t.Errorf("rules of %v should be loaded", file)
+				}
+				err = ioutil.WriteFile(name, []byte("*.bak\n"), 0644)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				i.Reload(path.Dir(file))
+				if i.Ignored("logs/a.tmp", false) || !i.Ignored("logs/a.bak", false) {
+					t.Errorf("rules of %v should be reloaded", file)
+				}
+				err = os.Remove(name)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				i.Reload(path.Dir(file))
+			},
+		)
+	}
+}
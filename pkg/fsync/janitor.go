@@ -0,0 +1,52 @@
+package fsync
+
+import (
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// janitorInterval interval of aborting incomplete uploads
+	janitorInterval = time.Hour
+)
+
+// janitorLoop abort incomplete uploads under the remote root which are older than
+// AbortUploadsAfter on start and every janitorInterval, until the server is closed. Uploads
+// of crashed processes are never completed and their parts are kept by the storage. Only the
+// uploads of the keys of the server are aborted, other hosts and jobs may share the root, and
+// uploads held by checkpoints are kept for resuming.
+func (s *server) janitorLoop() {
+	aborter, ok := s.storage.(api.UploadAborter)
+	if !ok || s.options.AbortUploadsAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		s.abortUploads(aborter)
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *server) abortUploads(aborter api.UploadAborter) {
+	log := logger.ContextLog(s.ctx)
+	before := time.Now().Add(-s.options.AbortUploadsAfter)
+	aborted, err := aborter.AbortUploads(
+		s.ctx, s.keys.root, before, func(path, uploadID string) bool {
+			_, ok := s.keys.rel(path)
+			return ok && !s.checkpoints.Has(path, uploadID)
+		},
+	)
+	if err != nil && s.ctx.Err() == nil {
+		log.Errorf("failed to abort incomplete uploads, error: %v", err.Error())
+	}
+	if aborted > 0 {
+		log.Infof("aborted incomplete uploads: %v started before: %v", aborted, before)
+	}
+}
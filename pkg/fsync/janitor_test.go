@@ -0,0 +1,91 @@
+package fsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+// abortingStorage storage which records the aborted uploads
+type abortingStorage struct {
+	*memory.Storage
+	prefixes chan string
+	match    func(path, uploadID string) bool
+}
+
+func (a *abortingStorage) AbortUploads(
+	ctx context.Context, prefix string, before time.Time,
+	match func(path, uploadID string) bool,
+) (int, error) {
+	a.match = match
+	a.prefixes <- prefix
+	return 1, nil
+}
+
+func Test_server_janitorLoop(t *testing.T) {
+	storage := &abortingStorage{
+		Storage:  memory.NewMemoryFileStorage(),
+		prefixes: make(chan string, 1),
+	}
+	s, _ := newTestServer(
+		t, tempDir(t), storage, OptionRemotePrefix("backup"),
+		OptionKeyTemplate("{yyyy}/{job}/{relpath}"), OptionJobName("logs"),
+		OptionAbortUploadsAfter(time.Hour),
+	)
+	// the upload held by the checkpoint is resumed, older uploads of the key are aborted
+	s.checkpoints.Put("/backup/2020/logs/b/c.txt", &api.Checkpoint{UploadID: "u2"})
+	done := make(chan struct{})
+	go func() {
+		s.janitorLoop()
+		close(done)
+	}()
+	select {
+	case prefix := <-storage.prefixes:
+		if prefix != "/backup/" {
+			t.Errorf("AbortUploads() prefix = %v, want /backup/", prefix)
+		}
+		matches := []struct {
+			path     string
+			uploadID string
+			want     bool
+		}{
+			{path: "/backup/2020/logs/a.txt", uploadID: "u1", want: true},
+			{path: "/backup/2020/logs/b/c.txt", uploadID: "u1", want: true},
+			{path: "/backup/2020/logs/b/c.txt", uploadID: "u2", want: false},
+			{path: "/backup/2020/other/a.txt", uploadID: "u1", want: false},
+			{path: "/backup/logs/a.txt", uploadID: "u1", want: false},
+		}
+		for _, m := range matches {
+			if got := storage.match(m.path, m.uploadID); got != m.want {
+				t.Errorf(
+					"AbortUploads() match(%v, %v) = %v, want %v", m.path, m.uploadID, got,
+					m.want,
+				)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout: uploads are aborted on start")
+	}
+	s.Close()
+	<-done
+}
+
+func Test_server_writeFile_abort(t *testing.T) {
+	storage := memory.NewMemoryFileStorage()
+	storage.SetFaults(memory.Faults{FailAfterBytes: 10})
+	s, _ := newTestServer(t, tempDir(t), storage)
+	_, err := s.writeFile("/a.txt", bytes.NewReader(make([]byte, 100)))
+	if !errors.Is(err, memory.ErrInjected) {
+		t.Fatalf("writeFile() error = %v, want %v", err, memory.ErrInjected)
+	}
+	storage.SetFaults(memory.Faults{})
+	_, err = storage.Info(context.Background(), "/a.txt")
+	if !errors.Is(err, api.ErrNotExist) {
+		t.Errorf("Info() of the aborted file, error = %v, want api.ErrNotExist", err)
+	}
+}
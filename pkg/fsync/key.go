@@ -0,0 +1,134 @@
+package fsync
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultKeyTemplate keys are the paths relative to the root path
+	defaultKeyTemplate = "{relpath}"
+	// relPathVariable variable of the path relative to the root path
+	relPathVariable = "{relpath}"
+)
+
+var (
+	keyVariablePattern = regexp.MustCompile(`\{[a-z]+\}`)
+	// keyTimeVariables time layouts of the time variables
+	keyTimeVariables = map[string]string{
+		"{yyyy}": "2006",
+		"{mm}":   "01",
+		"{dd}":   "02",
+		"{hh}":   "15",
+	}
+)
+
+// keySegment literal text, or time variable of the layout
+type keySegment struct {
+	text   string
+	layout string
+}
+
+// keyTemplate maps the slash separated path relative to the root path to the key in storage
+// and back. {hostname} and {job} are expanded when the template is parsed, time variables
+// are expanded with the local time of the first upload.
+type keyTemplate struct {
+	segments []keySegment
+	// root static prefix of all keys, it starts and ends with a slash
+	root string
+	// dynamic true if the template contains time variables
+	dynamic bool
+	pattern *regexp.Regexp
+}
+
+// newKeyTemplate parse the template under the remote prefix, the template must end with the
+// {relpath} path segment.
+func newKeyTemplate(prefix, template, hostname, job string) (*keyTemplate, error) {
+	if template == "" {
+		template = defaultKeyTemplate
+	}
+	full := path.Join("/", prefix, template)
+	if !strings.HasSuffix(full, "/"+relPathVariable) {
+		return nil, fmt.Errorf("key template: %v must end with %v", template, relPathVariable)
+	}
+	body := strings.TrimSuffix(full, relPathVariable)
+
+	k := &keyTemplate{}
+	expr := "^"
+	last := 0
+	literal := func(text string) {
+		k.segments = append(k.segments, keySegment{text: text})
+		expr += regexp.QuoteMeta(text)
+	}
+	for _, loc := range keyVariablePattern.FindAllStringIndex(body, -1) {
+		literal(body[last:loc[0]])
+		last = loc[1]
+		variable := body[loc[0]:loc[1]]
+		switch variable {
+		case "{hostname}":
+			literal(hostname)
+		case relPathVariable:
+			return nil, fmt.Errorf("%v must be used once in key template: %v", variable, template)
+		case "{job}":
+			if job == "" {
+				return nil, fmt.Errorf("job name is required by key template: %v", template)
+			}
+			literal(job)
+		default:
+			layout, ok := keyTimeVariables[variable]
+			if !ok {
+				return nil, fmt.Errorf("unknown variable: %v of key template: %v", variable, template)
+			}
+			k.segments = append(k.segments, keySegment{layout: layout})
+			expr += fmt.Sprintf(`\d{%d}`, len(layout))
+			k.dynamic = true
+		}
+	}
+	literal(body[last:])
+	k.pattern = regexp.MustCompile(expr + "(.+)$")
+
+	for _, segment := range k.segments {
+		if segment.layout != "" {
+			break
+		}
+		k.root += segment.text
+	}
+	k.root = k.root[:strings.LastIndex(k.root, "/")+1]
+	return k, nil
+}
+
+// key returns the key of the relative path at time t
+func (k *keyTemplate) key(rel string, t time.Time) string {
+	b := strings.Builder{}
+	for _, segment := range k.segments {
+		if segment.layout != "" {
+			b.WriteString(t.Format(segment.layout))
+		} else {
+			b.WriteString(segment.text)
+		}
+	}
+	b.WriteString(rel)
+	return b.String()
+}
+
+// rel returns the relative path of the key, returns false if the key isn't produced by the
+// template or the relative path isn't local, such as paths with ".." segments
+func (k *keyTemplate) rel(key string) (string, bool) {
+	match := k.pattern.FindStringSubmatch(key)
+	if match == nil || !localRel(match[1]) {
+		return "", false
+	}
+	return match[1], true
+}
+
+// localRel returns true if the slash separated path is clean and relative, and never escapes the
+// directory it's relative to
+func localRel(rel string) bool {
+	if rel == "" || rel == "." || path.IsAbs(rel) || path.Clean(rel) != rel {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, "../")
+}
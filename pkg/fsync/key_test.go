@@ -0,0 +1,98 @@
+package fsync
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_keyTemplate(t *testing.T) {
+	now := time.Date(2026, 10, 8, 9, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		prefix   string
+		template string
+		want     string
+		root     string
+		wantErr  bool
+	}{
+		{name: "default", want: "/a/b.txt", root: "/"},
+		{name: "prefix", prefix: "backup/", want: "/backup/a/b.txt", root: "/backup/"},
+		{
+			name: "host and job", prefix: "/backup", template: "{hostname}/{job}/{relpath}",
+			want: "/backup/host1/logs/a/b.txt", root: "/backup/host1/logs/",
+		},
+		{
+			name: "date", template: "{hostname}/{yyyy}/{mm}/{dd}/{relpath}",
+			want: "/host1/2026/10/08/a/b.txt", root: "/host1/",
+		},
+		{
+			name: "date first", template: "{yyyy}{mm}-{hostname}/{relpath}",
+			want: "/202610-host1/a/b.txt", root: "/",
+		},
+		{name: "relpath is not last", template: "{relpath}/{hostname}", wantErr: true},
+		{name: "relpath is not a segment", template: "{hostname}-{relpath}", wantErr: true},
+		{name: "relpath twice", template: "{relpath}/{relpath}", wantErr: true},
+		{name: "unknown variable", template: "{user}/{relpath}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				k, err := newKeyTemplate(tt.prefix, tt.template, "host1", "logs")
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("newKeyTemplate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if got := k.key("a/b.txt", now); got != tt.want {
+					t.Errorf("key() = %v, want %v", got, tt.want)
+				}
+				if k.root != tt.root {
+					t.Errorf("root = %v, want %v", k.root, tt.root)
+				}
+				if rel, ok := k.rel(tt.want); !ok || rel != "a/b.txt" {
+					t.Errorf("rel() = %v, %v, want a/b.txt", rel, ok)
+				}
+				if _, ok := k.rel("/host2/2026/10/08/a/b.txt"); ok && k.dynamic {
+					t.Errorf("rel() of other host is ok")
+				}
+			},
+		)
+	}
+
+	_, err := newKeyTemplate("", "{job}/{relpath}", "host1", "")
+	if err == nil {
+		t.Errorf("newKeyTemplate() without job name, error = nil")
+	}
+}
+
+func Test_keyTemplate_rel(t *testing.T) {
+	k, err := newKeyTemplate("backup", "", "host1", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{key: "/backup/a/b.txt", want: "a/b.txt", ok: true},
+		{key: "/backup/a/../b.txt"},
+		{key: "/backup/../../etc/passwd"},
+		{key: "/backup/.."},
+		{key: "/backup//etc/passwd"},
+		{key: "/backup/a//b.txt"},
+		{key: "/backup/"},
+		{key: "/other/a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.key, func(t *testing.T) {
+				got, ok := k.rel(tt.key)
+				if got != tt.want || ok != tt.ok {
+					t.Errorf("rel() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,36 @@
+package fsync
+
+import "context"
+
+// Limiter limits the number of concurrent operations of the servers sharing it
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter create limiter of n concurrent operations
+func NewLimiter(n int) *Limiter {
+	if n <= 0 {
+		n = 1
+	}
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+// acquire wait for a slot, returns false if ctx is done. A nil limiter never blocks.
+func (l *Limiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *Limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
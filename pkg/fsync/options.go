@@ -1,9 +1,87 @@
 package fsync
 
+import (
+	"time"
+)
+
 //go:generate go run github.com/launchdarkly/go-options  -type foptions
 type foptions struct {
-	BufferSize int
-	InitUpload bool
-	ConfPath   string
-	ThreadPoolSize int
+	BufferSize         int
+	InitUpload         bool
+	ConfPath           string
+	ThreadPoolSize     int
+	DeletePolicy       DeletePolicy
+	DeleteDelay        time.Duration
+	RestorePrefix      string
+	RestorePattern     string
+	RestorePolicy      RestorePolicy
+	TwoWay             bool
+	RemotePollInterval time.Duration
+	ConflictPolicy     ConflictPolicy
+	DebounceWindow     time.Duration
+	DebounceMaxDelay   time.Duration
+	QueueSize          int
+	RetryMaxAttempts   int
+	RetryBaseDelay     time.Duration
+	RetryMaxDelay      time.Duration
+	// ReconcileInterval interval of the full reconciliation scan, 0 means only rescan when the
+	// watcher drops events
+	ReconcileInterval time.Duration
+	// IgnorePatterns gitignore style patterns of files which are not synced
+	IgnorePatterns []string
+	// IncludePatterns gitignore style patterns, only matched files are synced if not empty
+	IncludePatterns []string
+	WatcherType     WatcherType
+	// PollInterval interval of scanning directories by the poll watcher
+	PollInterval time.Duration
+	// Watcher custom watcher, WatcherType is ignored if it's set
+	Watcher Watcher
+	// RemotePrefix remote directory of the root path
+	RemotePrefix string
+	// Limiter limits the concurrent operations of servers sharing it
+	Limiter *Limiter
+	// WatchAfterInit keep watching after the initial upload of InitUpload, the initial upload
+	// runs with the event loop so changes during the upload are not missed
+	WatchAfterInit bool
+	// KeyTemplate template of keys in storage under the RemotePrefix, e.g.
+	// {hostname}/{yyyy}/{mm}/{relpath}, see keyTemplate
+	KeyTemplate string
+	// JobName name of the sync job, it's expanded from {job} of the KeyTemplate
+	JobName string
+	// AbortUploadsAfter age of incomplete uploads which are aborted by the janitor, 0 disables
+	// the janitor
+	AbortUploadsAfter time.Duration
+	// StorageName name of the storage such as the endpoint and bucket, the sync state is kept
+	// per storage name and remote root
+	StorageName string
+}
+
+// validate parse and check the options
+func (o *foptions) validate() error {
+	var err error
+	o.DeletePolicy, err = ParseDeletePolicy(string(o.DeletePolicy))
+	if err != nil {
+		return err
+	}
+	o.ConflictPolicy, err = ParseConflictPolicy(string(o.ConflictPolicy))
+	if err != nil {
+		return err
+	}
+	o.WatcherType, err = ParseWatcherType(string(o.WatcherType))
+	if err != nil {
+		return err
+	}
+	if o.RetryMaxAttempts <= 0 {
+		o.RetryMaxAttempts = defaultRetryMaxAttempts
+	}
+	if o.RetryBaseDelay <= 0 {
+		o.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	if o.RetryMaxDelay <= 0 {
+		o.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if o.RetryMaxDelay < o.RetryBaseDelay {
+		o.RetryMaxDelay = o.RetryBaseDelay
+	}
+	return nil
 }
@@ -0,0 +1,198 @@
+package fsync
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultQueueSize default size of the pipeline queue
+	defaultQueueSize = 1024
+)
+
+// operations of tasks
+const (
+	opUpload   = "upload"
+	opDelete   = "delete"
+	opMove     = "move"
+	opDownload = "download"
+)
+
+// task operation of a path
+type task struct {
+	path string
+	op   string
+	fn   func()
+	// tree the task operates on the subtree of the path, such as deleting a directory
+	tree bool
+}
+
+// pipeline executes tasks by bounded workers. Tasks of the same path are executed in order and
+// never concurrently, and a task is dropped if the last waiting task of the path has the same
+// operation. Tree tasks never run concurrently with tasks of the paths in their subtree. Submit
+// blocks if the queue is full.
+type pipeline struct {
+	ctx context.Context
+	// limiter limits the running tasks of all pipelines sharing it, it may be nil
+	limiter *Limiter
+	queue   chan *task
+	mutex   sync.Mutex
+	// paths waiting tasks of the busy paths, a path is busy if it's in the map
+	paths map[string][]*task
+	wg    sync.WaitGroup
+	// running running tasks by path
+	running map[string]*task
+	// left closed and replaced when a running task is done
+	left    chan struct{}
+	workers sync.WaitGroup
+}
+
+// newPipeline create pipeline and start workers, workers exit when ctx is done
+func newPipeline(ctx context.Context, workers int, queueSize int, limiter *Limiter) *pipeline {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	p := &pipeline{
+		ctx:     ctx,
+		limiter: limiter,
+		queue:   make(chan *task, queueSize),
+		paths:   make(map[string][]*task),
+		running: make(map[string]*task),
+		left:    make(chan struct{}),
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit submit the task, it blocks until the queue has space or ctx is done
+func (p *pipeline) Submit(t *task) {
+	p.mutex.Lock()
+	waiting, busy := p.paths[t.path]
+	if busy {
+		if n := len(waiting); n == 0 || waiting[n-1].op != t.op {
+			p.wg.Add(1)
+			p.paths[t.path] = append(waiting, t)
+		}
+		p.mutex.Unlock()
+		return
+	}
+	p.wg.Add(1)
+	p.paths[t.path] = nil
+	p.mutex.Unlock()
+
+	select {
+	case p.queue <- t:
+	case <-p.ctx.Done():
+		p.finish(t)
+	}
+}
+
+// Wait wait until all submitted tasks are done or ctx is done
+func (p *pipeline) Wait() {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-p.ctx.Done():
+	}
+}
+
+// Close wait until the workers exit, ctx must be done before it
+func (p *pipeline) Close() {
+	p.workers.Wait()
+}
+
+func (p *pipeline) work() {
+	defer p.workers.Done()
+	for {
+		select {
+		case t := <-p.queue:
+			// run the waiting tasks of the path on the same worker to keep the order
+			for t != nil {
+				if p.enter(t) {
+					if p.limiter.acquire(p.ctx) {
+						t.fn()
+						p.limiter.release()
+					}
+					p.leave(t)
+				}
+				t = p.finish(t)
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// enter wait until no running task overlaps the task, and mark it running. Returns false if ctx
+// is done.
+func (p *pipeline) enter(t *task) bool {
+	for {
+		p.mutex.Lock()
+		if !p.overlapped(t) {
+			p.running[t.path] = t
+			p.mutex.Unlock()
+			return true
+		}
+		left := p.left
+		p.mutex.Unlock()
+		select {
+		case <-left:
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+}
+
+// leave mark the task done and wake up the waiting tasks
+func (p *pipeline) leave(t *task) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.running, t.path)
+	close(p.left)
+	p.left = make(chan struct{})
+}
+
+// overlapped returns true if a running task of a tree contains the path of the task, or the task
+// is a tree containing the path of a running task
+func (p *pipeline) overlapped(t *task) bool {
+	for path, r := range p.running {
+		if (r.tree && subpath(t.path, path)) || (t.tree && subpath(path, t.path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// subpath returns true if the path is the directory or in it
+func subpath(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// finish mark the task done and returns the next waiting task of the path
+func (p *pipeline) finish(t *task) *task {
+	defer p.wg.Done()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	waiting := p.paths[t.path]
+	if len(waiting) == 0 || p.ctx.Err() != nil {
+		for range waiting {
+			p.wg.Done()
+		}
+		delete(p.paths, t.path)
+		return nil
+	}
+	p.paths[t.path] = waiting[1:]
+	return waiting[0]
+}
@@ -0,0 +1,204 @@
+package fsync
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_pipeline_Submit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPipeline(ctx, 4, 2, nil)
+
+	var running, maxRunning int64
+	mutex := sync.Mutex{}
+	busy := make(map[string]bool)
+	orders := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("file-%d", i%5)
+		i := i
+		p.Submit(
+			&task{
+				path: path,
+				op:   fmt.Sprintf("op-%d", i),
+				fn: func() {
+					mutex.Lock()
+					if busy[path] {
+						t.Errorf("path: %v is processed concurrently", path)
+					}
+					busy[path] = true
+					orders[path] = append(orders[path], i)
+					mutex.Unlock()
+
+					n := atomic.AddInt64(&running, 1)
+					for {
+						m := atomic.LoadInt64(&maxRunning)
+						if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt64(&running, -1)
+
+					mutex.Lock()
+					busy[path] = false
+					mutex.Unlock()
+				},
+			},
+		)
+	}
+	p.Wait()
+
+	for path, order := range orders {
+		if len(order) != 20 {
+			t.Errorf("path: %v processed %v tasks, want 20", path, len(order))
+		}
+		for i := 1; i < len(order); i++ {
+			if order[i] < order[i-1] {
+				t.Errorf("path: %v processed out of order: %v", path, order)
+				break
+			}
+		}
+	}
+	if maxRunning > 4 {
+		t.Errorf("max running workers = %v, want <= 4", maxRunning)
+	}
+}
+
+func Test_pipeline_coalesce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPipeline(ctx, 1, 1, nil)
+
+	var count int64
+	block := make(chan struct{})
+	p.Submit(
+		&task{
+			path: "file", op: opUpload, fn: func() {
+				<-block
+				atomic.AddInt64(&count, 1)
+			},
+		},
+	)
+	for i := 0; i < 10; i++ {
+		p.Submit(
+			&task{
+				path: "file", op: opUpload, fn: func() {
+					atomic.AddInt64(&count, 1)
+				},
+			},
+		)
+	}
+	close(block)
+	p.Wait()
+	if count != 2 {
+		t.Errorf("uploads = %v, want 2", count)
+	}
+}
+
+func Test_pipeline_limiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	limiter := NewLimiter(2)
+	pipelines := []*pipeline{
+		newPipeline(ctx, 4, 0, limiter), newPipeline(ctx, 4, 0, limiter),
+	}
+
+	var running, maxRunning int64
+	for i := 0; i < 40; i++ {
+		pipelines[i%2].Submit(
+			&task{
+				path: fmt.Sprintf("file-%d", i),
+				op:   opUpload,
+				fn: func() {
+					n := atomic.AddInt64(&running, 1)
+					for {
+						m := atomic.LoadInt64(&maxRunning)
+						if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt64(&running, -1)
+				},
+			},
+		)
+	}
+	for _, p := range pipelines {
+		p.Wait()
+	}
+	if maxRunning > 2 {
+		t.Errorf("max running tasks = %v, want <= 2", maxRunning)
+	}
+}
+
+func Test_pipeline_tree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPipeline(ctx, 4, 0, nil)
+
+	dir := filepath.Join("data", "dir")
+	var inside, tree int64
+	for i := 0; i < 40; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("file-%d", i%4))
+		if i%10 == 0 {
+			p.Submit(
+				&task{
+					path: dir, op: opDelete, tree: true, fn: func() {
+						if atomic.AddInt64(&tree, 1) > 1 || atomic.LoadInt64(&inside) > 0 {
+							t.Errorf("tree task runs with tasks in the subtree")
+						}
+						time.Sleep(time.Millisecond)
+						atomic.AddInt64(&tree, -1)
+					},
+				},
+			)
+		}
+		p.Submit(
+			&task{
+				path: file, op: fmt.Sprintf("op-%d", i), fn: func() {
+					atomic.AddInt64(&inside, 1)
+					if atomic.LoadInt64(&tree) > 0 {
+						t.Errorf("task of file: %v runs with the tree task", file)
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt64(&inside, -1)
+				},
+			},
+		)
+	}
+	// files outside of the tree aren't blocked
+	other := make(chan struct{})
+	p.Submit(&task{path: filepath.Join("data", "dir2"), op: opUpload, fn: func() { close(other) }})
+	<-other
+	p.Wait()
+}
+
+func Test_pipeline_Close(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newPipeline(ctx, 2, 0, nil)
+
+	var done int64
+	started := make(chan struct{})
+	p.Submit(
+		&task{
+			path: "file", op: opUpload, fn: func() {
+				close(started)
+				<-ctx.Done()
+				time.Sleep(10 * time.Millisecond)
+				atomic.StoreInt64(&done, 1)
+			},
+		},
+	)
+	<-started
+	cancel()
+	p.Close()
+	if atomic.LoadInt64(&done) != 1 {
+		t.Errorf("Close() returns before the running task is done")
+	}
+}
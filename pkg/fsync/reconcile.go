@@ -0,0 +1,171 @@
+package fsync
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+// reconcileLoop reconcile the local tree with the storage on start if immediate is true, then
+// every ReconcileInterval and whenever a rescan is requested, until the server is closed
+func (s *server) reconcileLoop(immediate bool) {
+	var tick <-chan time.Time
+	if s.options.ReconcileInterval > 0 {
+		ticker := time.NewTicker(s.options.ReconcileInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		if immediate {
+			s.reconcile()
+		}
+	}
+	for {
+		select {
+		case <-tick:
+		case <-s.rescan:
+		case <-s.ctx.Done():
+			return
+		}
+		s.reconcile()
+	}
+}
+
+// requestRescan request an immediate reconciliation, it's called when the watcher drops events
+func (s *server) requestRescan() {
+	select {
+	case s.rescan <- struct{}{}:
+	default:
+		// a rescan is already pending
+	}
+}
+
+// reconcile upload local files which are new or changed since the last sync, or missing in the
+// storage, and remove remote files which are missing locally by the DeletePolicy. Remote-only
+// files are downloaded by the poller instead in two-way mode.
+func (s *server) reconcile() {
+	log := logger.ContextLog(s.ctx)
+	log.Infof("reconcile path: %v", s.rootPath)
+	start := time.Now()
+	remote := make(map[string]*api.FileInfo)
+	err := api.Walk(
+		s.ctx, s.storage, s.keys.root, func(info *api.FileInfo) error {
+			rel, ok := s.keys.rel(info.Path)
+			if ok && preferred(s.state, rel, info, remote[rel]) {
+				remote[rel] = info
+			}
+			return s.ctx.Err()
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to list remote files, error: %v", err.Error())
+		return
+	}
+
+	uploads := 0
+	err = filepath.Walk(
+		s.rootPath, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Errorf("failed to walk file: %v, error: %v", file, err.Error())
+				return nil
+			}
+			if s.ctx.Err() != nil {
+				return s.ctx.Err()
+			}
+			if isTempFile(file) || !syncable(info) || s.ignored(file, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				// watches may be lost with the dropped events
+				err := s.watchDir(file)
+				if err != nil {
+					log.Errorf("failed to watch file: %v", file)
+				}
+				return nil
+			}
+			key := s.statePath(file)
+			r, ok := remote[key]
+			delete(remote, key)
+			if s.diverged(key, info, r, ok) {
+				uploads++
+				s.submitUpload(file)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to walk path: %v, error: %v", s.rootPath, err.Error())
+		return
+	}
+
+	deletions := 0
+	if !s.options.TwoWay && s.options.DeletePolicy != DeletePolicyNever {
+		for rel := range remote {
+			file := s.filePath(rel)
+			if isTempFile(file) || s.ignored(file, false) {
+				continue
+			}
+			if _, err := os.Lstat(file); err == nil {
+				// created after the walk
+				continue
+			}
+			deletions++
+			s.removeFile(file, false)
+		}
+	}
+	log.Infof(
+		"reconciled path: %v in %v, uploads: %v, deletions: %v", s.rootPath,
+		time.Since(start), uploads, deletions,
+	)
+}
+
+// preferred returns true if the remote file is preferred to the other file of the same path,
+// which exist if the key template contains time variables. The file of the recorded key is
+// preferred, then the latest one.
+func preferred(store *stateStore, rel string, info *api.FileInfo, other *api.FileInfo) bool {
+	if other == nil {
+		return true
+	}
+	if state, ok := store.Get(rel); ok && state.Key != "" {
+		if other.Path == state.Key {
+			return false
+		}
+		if info.Path == state.Key {
+			return true
+		}
+	}
+	return info.ModTime.After(other.ModTime)
+}
+
+// diverged returns true if the local file should be uploaded. Files without state are treated
+// as synced if the remote file has the same size and is uploaded after the local mtime.
+func (s *server) diverged(key string, stat os.FileInfo, info *api.FileInfo, exists bool) bool {
+	state, ok := s.state.Get(key)
+	if !exists {
+		if ok {
+			// the remote file is lost, upload it again regardless of the state
+			s.state.Delete(key)
+		}
+		return true
+	}
+	if ok {
+		return !state.unchanged(stat)
+	}
+	if info.Size != stat.Size() || info.ModTime.Before(stat.ModTime()) {
+		return true
+	}
+	s.state.Put(
+		key, &fileState{
+			Size:     stat.Size(),
+			ModTime:  stat.ModTime(),
+			ETag:     remoteVersion(info),
+			Key:      info.Path,
+			SyncedAt: time.Now(),
+		},
+	)
+	return false
+}
@@ -0,0 +1,69 @@
+package fsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/backend/fs"
+)
+
+func Test_server_reconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-reconcile")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "remote")
+	files := map[string]string{
+		filepath.Join(local, "new.txt"):      "new",
+		filepath.Join(local, "changed.txt"):  "changed",
+		filepath.Join(local, "synced.txt"):   "synced",
+		filepath.Join(remote, "changed.txt"): "old",
+		filepath.Join(remote, "synced.txt"):  "synced",
+		filepath.Join(remote, "removed.txt"): "removed",
+	}
+	for file, content := range files {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(file, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// the remote file is uploaded after the local file is written
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"changed.txt", "synced.txt"} {
+		err = os.Chtimes(filepath.Join(local, name), past, past)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	storage, err := fs.NewLocalFileStorage(remote)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, _ := newTestServer(t, local, storage, OptionDeletePolicy(DeletePolicyImmediate))
+
+	s.reconcile()
+	s.pipeline.Wait()
+
+	want := map[string]string{"new.txt": "new", "changed.txt": "changed", "synced.txt": "synced"}
+	for name, content := range want {
+		data, err := ioutil.ReadFile(filepath.Join(remote, name))
+		if err != nil || string(data) != content {
+			t.Errorf("remote file: %v = %q, %v, want %q", name, data, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remote, "removed.txt")); !os.IsNotExist(err) {
+		t.Errorf("remote file: removed.txt is not deleted, error: %v", err)
+	}
+	if _, ok := s.state.Get("synced.txt"); !ok {
+		t.Errorf("state of synced file is not recorded")
+	}
+}
@@ -0,0 +1,185 @@
+package fsync
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// renameWindow max duration to wait for the create event paired with a rename event,
+	// fsnotify reports a move as a rename of the old name directly followed by a create of the
+	// new name.
+	renameWindow = 500 * time.Millisecond
+)
+
+// renameEvent rename event waiting for the paired create event
+type renameEvent struct {
+	file  string
+	isDir bool
+	timer *time.Timer
+	// stat info of the directory when it was watched, nil for files
+	stat os.FileInfo
+}
+
+// renameFile remember the renamed file, it's treated as a removal if no create event follows
+func (s *server) renameFile(file string) {
+	s.renameMutex.Lock()
+	defer s.renameMutex.Unlock()
+	if _, ok := s.movedDirs[file]; ok {
+		// the moved directory reports a rename event of itself after the paired events
+		delete(s.movedDirs, file)
+		return
+	}
+	r := &renameEvent{file: file}
+	r.stat, r.isDir = s.unwatchDir(file)
+	if r.isDir {
+		s.movedDirs[file] = struct{}{}
+		time.AfterFunc(
+			renameWindow, func() {
+				s.renameMutex.Lock()
+				delete(s.movedDirs, file)
+				s.renameMutex.Unlock()
+			},
+		)
+	}
+	s.pendingRename = r
+	r.timer = time.AfterFunc(
+		renameWindow, func() {
+			if s.takeRename(r) {
+				s.removeFile(r.file, r.isDir)
+			}
+		},
+	)
+}
+
+// takeRename take the pending rename event, returns false if the event is already taken
+func (s *server) takeRename(r *renameEvent) bool {
+	s.renameMutex.Lock()
+	defer s.renameMutex.Unlock()
+	if r == nil || s.pendingRename != r {
+		return false
+	}
+	s.pendingRename = nil
+	r.timer.Stop()
+	return true
+}
+
+func (s *server) currentRename() *renameEvent {
+	s.renameMutex.Lock()
+	defer s.renameMutex.Unlock()
+	return s.pendingRename
+}
+
+// flushRename treat the pending rename event as a removal, it's called when the next event
+// isn't the paired create event, which means the file is moved out of the root path.
+func (s *server) flushRename() {
+	r := s.currentRename()
+	if s.takeRename(r) {
+		s.removeFile(r.file, r.isDir)
+	}
+}
+
+// pairRename move the pending renamed file to the created file, returns false if there is no
+// pending rename event or the created file isn't the renamed file
+func (s *server) pairRename(file string) bool {
+	r := s.currentRename()
+	if r == nil || !s.moved(r, file) || !s.takeRename(r) {
+		return false
+	}
+	s.cancelDelete(file)
+	s.pipeline.Submit(
+		&task{
+			path: file,
+			op:   opMove,
+			fn: func() {
+				s.moveFile(r.file, file, r.isDir)
+			},
+			tree: r.isDir,
+		},
+	)
+	return true
+}
+
+// moved returns true if the created file is the renamed file, a rename keeps the size and mtime
+// of the file, so they must match the synced state of the renamed path. A rename keeps the
+// directory itself, so it must be the same file as the renamed directory when it was watched.
+func (s *server) moved(r *renameEvent, file string) bool {
+	stat, err := os.Lstat(file)
+	if err != nil || stat.IsDir() != r.isDir {
+		return false
+	}
+	if r.isDir {
+		return r.stat != nil && os.SameFile(r.stat, stat)
+	}
+	state, ok := s.state.Get(s.statePath(r.file))
+	return ok && state.unchanged(stat)
+}
+
+// moveFile move files in storage instead of uploading them again, the files are uploaded if
+// failed to move.
+func (s *server) moveFile(from string, to string, isDir bool) {
+	log := logger.ContextLog(s.ctx)
+	log.Infof("move file: %v to: %v", from, to)
+	if !isDir {
+		s.moveRemote(from, to)
+		return
+	}
+	err := filepath.Walk(
+		to, func(subPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Errorf("failed to walk file: %v, error: %v", subPath, err.Error())
+				return nil
+			}
+			if !syncable(info) || s.ignored(subPath, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				err := s.watchDir(subPath)
+				if err != nil {
+					log.Errorf("failed to watch file: %v", subPath)
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(to, subPath)
+			if err != nil {
+				return err
+			}
+			s.moveRemote(filepath.Join(from, rel), subPath)
+			return nil
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to move dir: %v to: %v, error: %v", from, to, err.Error())
+	}
+}
+
+// moveRemote move a single file in storage, the old file is kept if the delete policy is never.
+func (s *server) moveRemote(from string, to string) {
+	log := logger.ContextLog(s.ctx)
+	src := s.remotePath(from)
+	dst := s.remotePath(to)
+	var err error
+	if s.options.DeletePolicy == DeletePolicyNever {
+		err = s.storage.Copy(s.ctx, src, dst)
+	} else {
+		err = s.storage.Move(s.ctx, src, dst)
+	}
+	if err == nil {
+		s.state.Rename(s.statePath(from), s.statePath(to))
+		if state, ok := s.state.Get(s.statePath(to)); ok {
+			state.Key = dst
+			s.state.Put(s.statePath(to), state)
+		}
+		return
+	}
+	log.Warnf(
+		"failed to move file: %v to: %v, upload it instead, error: %v", src, dst, err.Error(),
+	)
+	s.runOperation(&operation{op: opUpload, file: to, attempt: 1})
+}
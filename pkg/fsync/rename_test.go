@@ -0,0 +1,149 @@
+package fsync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+// remoteData returns the content of the remote file, or false if it doesn't exist
+func remoteData(storage *memory.Storage, path string) (string, bool) {
+	reader, err := storage.Get(context.Background(), path)
+	if err != nil {
+		return "", false
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	data, err := ioutil.ReadAll(reader)
+	return string(data), err == nil
+}
+
+func Test_server_rename(t *testing.T) {
+	local := tempDir(t)
+	remote := memory.NewMemoryFileStorage()
+	storage := &countingStorage{FileStorage: remote, uploads: make(map[string]int)}
+	s, watcher := newTestServer(
+		t, local, storage, OptionDebounceWindow(0), OptionDeletePolicy(DeletePolicyImmediate),
+	)
+	go s.watchFile()
+
+	write := func(rel string, data string) string {
+		file := filepath.Join(local, filepath.FromSlash(rel))
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(file, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Create}
+		eventually(
+			t, "file: "+rel+" is uploaded", func() bool {
+				got, ok := remoteData(remote, "/"+rel)
+				return ok && got == data
+			},
+		)
+		return file
+	}
+	rename := func(from string, to string) {
+		err := os.Rename(from, to)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		watcher.events <- fsnotify.Event{Name: from, Op: fsnotify.Rename}
+		watcher.events <- fsnotify.Event{Name: to, Op: fsnotify.Create}
+	}
+	removed := func(path string) func() bool {
+		return func() bool {
+			_, ok := remoteData(remote, path)
+			return !ok
+		}
+	}
+
+	t.Run(
+		"move file", func(t *testing.T) {
+			file := write("a.txt", "aaaa")
+			rename(file, filepath.Join(local, "b.txt"))
+			eventually(t, "old file is moved", removed("/a.txt"))
+			if got, ok := remoteData(remote, "/b.txt"); !ok || got != "aaaa" {
+				t.Errorf("moved file = %q, %v, want aaaa", got, ok)
+			}
+			if n := storage.count("/b.txt"); n != 0 {
+				t.Errorf("moved file is uploaded %v times, want 0", n)
+			}
+		},
+	)
+
+	t.Run(
+		"unrelated create", func(t *testing.T) {
+			file := write("c.txt", "cccc")
+			// the file is moved out of the root path, and another file is created
+			err := os.Rename(file, filepath.Join(tempDir(t), "c.txt"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			created := filepath.Join(local, "d.txt")
+			err = ioutil.WriteFile(created, []byte("dd"), 0644)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Rename}
+			watcher.events <- fsnotify.Event{Name: created, Op: fsnotify.Create}
+			eventually(t, "renamed file is deleted", removed("/c.txt"))
+			eventually(
+				t, "created file is uploaded", func() bool {
+					got, ok := remoteData(remote, "/d.txt")
+					return ok && got == "dd"
+				},
+			)
+		},
+	)
+
+	t.Run(
+		"move directory", func(t *testing.T) {
+			write("dir/e.txt", "eeee")
+			err := s.watchDir(filepath.Join(local, "dir"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			rename(filepath.Join(local, "dir"), filepath.Join(local, "dir2"))
+			eventually(t, "old directory is moved", removed("/dir/e.txt"))
+			if got, ok := remoteData(remote, "/dir2/e.txt"); !ok || got != "eeee" {
+				t.Errorf("moved file = %q, %v, want eeee", got, ok)
+			}
+		},
+	)
+
+	t.Run(
+		"unrelated mkdir", func(t *testing.T) {
+			write("dir3/f.txt", "ffff")
+			dir := filepath.Join(local, "dir3")
+			err := s.watchDir(dir)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			// the directory is moved out of the root path, and another directory is created
+			err = os.Rename(dir, filepath.Join(tempDir(t), "dir3"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			created := filepath.Join(local, "dir4")
+			err = os.Mkdir(created, 0755)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			watcher.events <- fsnotify.Event{Name: dir, Op: fsnotify.Rename}
+			watcher.events <- fsnotify.Event{Name: created, Op: fsnotify.Create}
+			eventually(t, "renamed directory is deleted", removed("/dir3/f.txt"))
+			if _, ok := s.state.Get("dir3/f.txt"); ok {
+				t.Errorf("state of the renamed directory is kept")
+			}
+		},
+	)
+}
@@ -0,0 +1,385 @@
+package fsync
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/threadpool"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// tempFilePrefix name prefix of the temp files of downloading
+	tempFilePrefix = ".fsync-download-"
+)
+
+// RestorePolicy policy of restoring files which already exist locally
+type RestorePolicy string
+
+const (
+	// RestorePolicyOverwrite always overwrite local files
+	RestorePolicyOverwrite RestorePolicy = "overwrite"
+	// RestorePolicySkipIdentical skip local files which content is identical to the remote
+	RestorePolicySkipIdentical RestorePolicy = "skip-identical"
+	// RestorePolicySkipExisting skip all existing local files
+	RestorePolicySkipExisting RestorePolicy = "skip-existing"
+)
+
+// ParseRestorePolicy parse restore policy, empty string means RestorePolicySkipIdentical
+func ParseRestorePolicy(policy string) (RestorePolicy, error) {
+	switch p := RestorePolicy(policy); p {
+	case "":
+		return RestorePolicySkipIdentical, nil
+	case RestorePolicyOverwrite, RestorePolicySkipIdentical, RestorePolicySkipExisting:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown restore policy: %v", policy)
+}
+
+type restorer struct {
+	ctx      context.Context
+	rootPath string
+	storage  api.FileStorage
+	options  *foptions
+	state    *stateStore
+	keys     *keyTemplate
+}
+
+// Restore download files under the RestorePrefix which match the RestorePattern from storage
+// to the root path, the latest file of each path is restored if the KeyTemplate contains time
+// variables.
+func Restore(ctx context.Context, rootPath string, storage api.FileStorage, opts ...Option) error {
+	log := logger.ContextLog(ctx)
+	o, err := newFoptions(opts...)
+	if err != nil {
+		return err
+	}
+	o.RestorePolicy, err = ParseRestorePolicy(string(o.RestorePolicy))
+	if err != nil {
+		return err
+	}
+	if o.RestorePattern != "" {
+		_, err = path.Match(o.RestorePattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid restore pattern: %v, error: %v", o.RestorePattern, err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	keys, err := newKeyTemplate(o.RemotePrefix, o.KeyTemplate, hostname, o.JobName)
+	if err != nil {
+		return err
+	}
+	state, err := openStateStore(stateFilePath(o.ConfPath, o.StorageName, keys.root))
+	if err != nil {
+		log.Errorf("failed to open state store, error: %v", err.Error())
+		return err
+	}
+	r := &restorer{
+		ctx:      ctx,
+		rootPath: rootPath,
+		storage:  storage,
+		options:  &o,
+		state:    state,
+		keys:     keys,
+	}
+	err = r.restore()
+	err2 := state.Flush()
+	if err2 != nil {
+		log.Errorf("failed to flush state, error: %v", err2.Error())
+	}
+	return err
+}
+
+func (r *restorer) restore() error {
+	log := logger.ContextLog(r.ctx)
+	restorePrefix := strings.TrimLeft(r.options.RestorePrefix, "/")
+	prefix := r.keys.root
+	if !r.keys.dynamic {
+		prefix += restorePrefix
+	}
+	log.Infof("restore files of prefix: %v to: %v", prefix, r.rootPath)
+
+	size := r.options.ThreadPoolSize
+	if size <= 0 {
+		size = 1
+	}
+	pool, err := threadpool.NewPool(r.ctx, size)
+	if err != nil {
+		log.Errorf("failed to create ThreadPool, error: %v", err.Error())
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	var total, failed int64
+	submit := func(rel string, info *api.FileInfo) {
+		total++
+		wg.Add(1)
+		pool.Run(
+			func() {
+				defer wg.Done()
+				err := r.restoreFile(rel, info)
+				if errors.Is(err, api.ErrNotExist) {
+					log.Warnf("remote file: %v is removed during restore", info.Path)
+					return
+				}
+				if err != nil {
+					log.Errorf("failed to restore file: %v, error: %v", info.Path, err.Error())
+					atomic.AddInt64(&failed, 1)
+				}
+			},
+		)
+	}
+	// latest files of the paths if the keys contain time
+	latest := make(map[string]*api.FileInfo)
+	err = api.Walk(
+		r.ctx, r.storage, prefix, func(info *api.FileInfo) error {
+			rel, ok := r.keys.rel(info.Path)
+			if !ok || !strings.HasPrefix(rel, restorePrefix) || !r.match(rel) {
+				return nil
+			}
+			if !r.keys.dynamic {
+				submit(rel, info)
+			} else if l, ok := latest[rel]; !ok || info.ModTime.After(l.ModTime) {
+				latest[rel] = info
+			}
+			return r.ctx.Err()
+		},
+	)
+	if err == nil {
+		for rel, info := range latest {
+			submit(rel, info)
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		log.Errorf("failed to list files of prefix: %v, error: %v", prefix, err.Error())
+		return err
+	}
+	log.Infof("restored files: %v, failed: %v", total-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to restore %d of %d files", failed, total)
+	}
+	return nil
+}
+
+// match returns true if the relative path matches the RestorePattern, patterns without slash
+// match the file name, otherwise match the path relative to the root.
+func (r *restorer) match(rel string) bool {
+	pattern := r.options.RestorePattern
+	if pattern == "" {
+		return true
+	}
+	name := rel
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(strings.TrimLeft(pattern, "/"), name)
+	return matched
+}
+
+func (r *restorer) restoreFile(rel string, info *api.FileInfo) error {
+	log := logger.ContextLog(r.ctx)
+	file, err := localFile(r.rootPath, rel)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(file)
+	if err == nil {
+		if stat.IsDir() {
+			return fmt.Errorf("local file: %v is a directory", file)
+		}
+		switch r.options.RestorePolicy {
+		case RestorePolicySkipExisting:
+			log.Debugf("file: %v exists, skip restore", file)
+			return nil
+		case RestorePolicySkipIdentical:
+			if identical(file, stat, info, int64(r.options.BufferSize)) {
+				log.Debugf("file: %v is identical, skip restore", file)
+				// the next sync doesn't upload it again
+				state, err := identicalState(file, stat, info)
+				if err != nil {
+					return err
+				}
+				r.state.Put(rel, state)
+				return nil
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Infof("restore file: %v", file)
+	return downloadFile(r.ctx, r.storage, r.state, rel, info, file)
+}
+
+// downloadFile download the remote file to the local file through a temp file, and record the
+// state of the key after the temp file is renamed. The file has the mode of the files of the fs
+// backend and the modification time of the remote file. Uploads of the file by the watcher wait for the
+// download in the pipeline, so they find the state.
+func downloadFile(
+	ctx context.Context, storage api.FileStorage, state *stateStore, key string,
+	info *api.FileInfo, file string,
+) error {
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	reader, err := storage.Get(ctx, info.Path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	tmp, err := ioutil.TempFile(filepath.Dir(file), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	h := sha256.New()
+	err = tmp.Chmod(0644)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(tmp, h), reader)
+	}
+	err2 := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	if !info.ModTime.IsZero() {
+		err = os.Chtimes(tmp.Name(), info.ModTime, info.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	stat, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		return err
+	}
+	state.Put(
+		key, &fileState{
+			Size:     stat.Size(),
+			ModTime:  stat.ModTime(),
+			Hash:     hex.EncodeToString(h.Sum(nil)),
+			ETag:     remoteVersion(info),
+			Key:      info.Path,
+			SyncedAt: time.Now(),
+		},
+	)
+	return nil
+}
+
+// identicalState returns the synced state of the local file which is identical to the remote file
+func identicalState(file string, stat os.FileInfo, info *api.FileInfo) (*fileState, error) {
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &fileState{
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		Hash:     hash,
+		ETag:     remoteVersion(info),
+		Key:      info.Path,
+		SyncedAt: time.Now(),
+	}, nil
+}
+
+// localFile returns the local file of the slash separated path relative to the root path, it
+// returns an error if the file is out of the root path
+func localFile(rootPath string, rel string) (string, error) {
+	file := filepath.Join(rootPath, filepath.FromSlash(rel))
+	r, err := filepath.Rel(rootPath, file)
+	if err != nil || r == "." || r == ".." ||
+		strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path: %v is out of the root path: %v", rel, rootPath)
+	}
+	return file, nil
+}
+
+// isTempFile returns true if the file is a temp file of fsync
+func isTempFile(file string) bool {
+	return strings.HasPrefix(filepath.Base(file), tempFilePrefix)
+}
+
+// identical returns true if the local file has the same size and etag with the remote file,
+// multipart etags are computed with the part size of the file uploaded in blocks of blockSize
+func identical(file string, stat os.FileInfo, info *api.FileInfo, blockSize int64) bool {
+	if stat.Size() != info.Size || info.ETag == "" {
+		return false
+	}
+	etag, err := localETag(file, api.PartSize(stat.Size(), blockSize), info.ETag)
+	if err != nil {
+		return false
+	}
+	return etag == info.ETag
+}
+
+// localETag returns the etag of the local file in the same form of the remote etag, which is
+// the md5 of the content, or the md5 of the part md5s followed by the part count for multipart
+// uploads of the partSize.
+func localETag(file string, partSize int64, remote string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	index := strings.LastIndex(remote, "-")
+	if index < 0 {
+		h := md5.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if partSize <= 0 {
+		return "", fmt.Errorf("unknown part size of multipart etag: %v", remote)
+	}
+	parts := 0
+	sums := md5.New()
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n > 0 || parts == 0 {
+			sums.Write(h.Sum(nil))
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return hex.EncodeToString(sums.Sum(nil)) + "-" + strconv.Itoa(parts), nil
+}
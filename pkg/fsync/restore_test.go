@@ -0,0 +1,94 @@
+package fsync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+func TestRestore(t *testing.T) {
+	dir := tempDir(t)
+	local := filepath.Join(dir, "local")
+	conf := filepath.Join(dir, "conf")
+	err := os.MkdirAll(local, 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(local, "a.txt"), []byte("aaaa"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := memory.NewMemoryFileStorage()
+	writeRemote(t, storage, "/backup/a.txt", []byte("aaaa"))
+	writeRemote(t, storage, "/backup/b/c.txt", []byte("cccc"))
+
+	err = Restore(
+		context.Background(), local, storage, OptionConfPath(conf), OptionRemotePrefix("backup"),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadFile(filepath.Join(local, "b", "c.txt"))
+	if err != nil || string(data) != "cccc" {
+		t.Errorf("restored file = %q, %v, want cccc", data, err)
+	}
+	stat, err := os.Stat(filepath.Join(local, "b", "c.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info, err := storage.Info(context.Background(), "/backup/b/c.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if runtime.GOOS != "windows" && stat.Mode().Perm() != 0644 {
+		t.Errorf("mode of restored file = %v, want %v", stat.Mode().Perm(), os.FileMode(0644))
+	}
+	if !stat.ModTime().Equal(info.ModTime) {
+		t.Errorf("mtime of restored file = %v, want %v", stat.ModTime(), info.ModTime)
+	}
+
+	// identical files which are skipped are recorded as synced
+	state, err := openStateStore(stateFilePath(conf, "", "/backup/"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keys := map[string]string{"a.txt": "/backup/a.txt", "b/c.txt": "/backup/b/c.txt"}
+	for rel, key := range keys {
+		s, ok := state.Get(rel)
+		if !ok || s.Key != key || s.Hash == "" {
+			t.Errorf("state of %v = %+v, want the synced state of %v", rel, s, key)
+		}
+	}
+}
+
+func Test_localFile(t *testing.T) {
+	root := filepath.Join("data", "root")
+	tests := []struct {
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{rel: "a/b.txt", want: filepath.Join(root, "a", "b.txt")},
+		{rel: "a/../b.txt", want: filepath.Join(root, "b.txt")},
+		{rel: "../b.txt", wantErr: true},
+		{rel: "a/../../../etc/passwd", wantErr: true},
+		{rel: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.rel, func(t *testing.T) {
+				got, err := localFile(root, tt.rel)
+				if (err != nil) != tt.wantErr || got != tt.want {
+					t.Errorf(
+						"localFile() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr,
+					)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,194 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// defaultRetryMaxAttempts default attempts of an operation before it's dead-lettered
+	defaultRetryMaxAttempts = 5
+	// defaultRetryBaseDelay default delay before the first retry
+	defaultRetryBaseDelay = time.Second
+	// defaultRetryMaxDelay default upper bound of the retry delay
+	defaultRetryMaxDelay = 5 * time.Minute
+)
+
+// operation remote operation of a local path, failed operations are retried
+type operation struct {
+	op      string
+	file    string
+	isDir   bool
+	attempt int
+}
+
+// submitOperation submit the operation to the pipeline
+func (s *server) submitOperation(o *operation) {
+	s.pipeline.Submit(
+		&task{
+			path: o.file,
+			op:   o.op,
+			fn: func() {
+				s.runOperation(o)
+			},
+			tree: o.op == opDelete && o.isDir,
+		},
+	)
+}
+
+// runOperation run the operation and retry it on failure
+func (s *server) runOperation(o *operation) {
+	err := s.doOperation(o)
+	if err != nil {
+		s.retry(o, err)
+		return
+	}
+	s.settle(o)
+}
+
+func (s *server) doOperation(o *operation) error {
+	switch o.op {
+	case opUpload:
+		return s.uploadFile(o.file)
+	case opDelete:
+		return s.deleteRemote(o.file, o.isDir)
+	}
+	return fmt.Errorf("unknown operation: %v", o.op)
+}
+
+// retry resubmit the failed operation after an exponential backoff, the operation is written to
+// the dead-letter journal if the error is permanent or all attempts are failed.
+func (s *server) retry(o *operation, err error) {
+	log := logger.ContextLog(s.ctx)
+	if s.ctx.Err() != nil {
+		return
+	}
+	if s.obsolete(o) {
+		log.Debugf("drop %v of file: %v, error: %v", o.op, o.file, err.Error())
+		s.dropObsolete(o)
+		return
+	}
+	if !retryable(err) || o.attempt >= s.options.RetryMaxAttempts {
+		log.Errorf(
+			"failed to %v file: %v after %v attempts, error: %v", o.op, o.file, o.attempt,
+			err.Error(),
+		)
+		s.deadLetter(o, err)
+		return
+	}
+	delay := backoff(o.attempt, s.options.RetryBaseDelay, s.options.RetryMaxDelay)
+	log.Warnf("failed to %v file: %v, retry after %v, error: %v", o.op, o.file, delay, err.Error())
+	time.AfterFunc(
+		delay, func() {
+			if s.ctx.Err() != nil {
+				return
+			}
+			if s.obsolete(o) {
+				s.dropObsolete(o)
+				return
+			}
+			s.submitOperation(
+				&operation{op: o.op, file: o.file, isDir: o.isDir, attempt: o.attempt + 1},
+			)
+		},
+	)
+}
+
+// obsolete returns true if the operation is superseded by local changes: uploads of removed
+// files are replaced by the deletions, and deletions of created files by the uploads.
+func (s *server) obsolete(o *operation) bool {
+	_, err := os.Lstat(o.file)
+	switch o.op {
+	case opUpload:
+		return os.IsNotExist(err)
+	case opDelete:
+		return err == nil
+	}
+	return false
+}
+
+// deadLetter write the operation to the dead-letter journal, it replaces the letter of the last
+// failure of the operation. The checkpoints of the upload are dropped, it starts over when the
+// letter is replayed.
+func (s *server) deadLetter(o *operation, err error) {
+	if o.op == opUpload {
+		s.dropFileCheckpoints(o.file, false)
+	}
+	if s.deadLetters == nil {
+		return
+	}
+	err2 := s.deadLetters.Append(
+		&DeadLetter{
+			Op:       o.op,
+			Path:     o.file,
+			IsDir:    o.isDir,
+			Attempts: o.attempt,
+			Error:    err.Error(),
+			Time:     time.Now(),
+		},
+	)
+	if err2 != nil {
+		logger.ContextLog(s.ctx).Errorf(
+			"failed to write dead letter of file: %v, error: %v", o.file, err2.Error(),
+		)
+	}
+}
+
+// dropObsolete settle the operation which is superseded by local changes, the uploads of the
+// removed file are never resumed
+func (s *server) dropObsolete(o *operation) {
+	if o.op == opUpload {
+		s.dropFileCheckpoints(o.file, false)
+	}
+	s.settle(o)
+}
+
+// settle remove the dead letter of the operation which succeeds or is dropped, the letter of the
+// last run is kept in the journal until then
+func (s *server) settle(o *operation) {
+	if s.deadLetters == nil {
+		return
+	}
+	err := s.deadLetters.Remove(o.op, o.file)
+	if err != nil {
+		logger.ContextLog(s.ctx).Errorf(
+			"failed to remove dead letter of file: %v, error: %v", o.file, err.Error(),
+		)
+	}
+}
+
+// retryable returns false if retrying never succeeds, such as permission errors of the local
+// file or the storage, and conflicts which need to be resolved
+func retryable(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		return false
+	case errors.Is(err, api.ErrNotExist), errors.Is(err, api.ErrPermission),
+		errors.Is(err, api.ErrConflict):
+		return false
+	}
+	return true
+}
+
+// backoff returns the delay before the next attempt, it doubles on every attempt up to max, and
+// is randomized in the upper half to spread retries of the failed files.
+func backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
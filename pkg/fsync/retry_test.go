@@ -0,0 +1,251 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+func Test_backoff(t *testing.T) {
+	base := time.Second
+	max := 10 * time.Second
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: 2 * time.Second},
+		{attempt: 3, want: 4 * time.Second},
+		{attempt: 5, want: max},
+		{attempt: 100, want: max},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt-%d", tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := backoff(tt.attempt, base, max)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("backoff() = %v, want in [%v, %v]", got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_retryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "not exist", err: &os.PathError{Op: "open", Path: "a", Err: os.ErrNotExist}, want: false},
+		{name: "permission", err: fmt.Errorf("upload: %w", os.ErrPermission), want: false},
+		{name: "network", err: errors.New("connection reset by peer"), want: true},
+		{
+			name: "remote not exist", want: false,
+			err: api.Wrap("get", "/a", api.ErrNotExist, errors.New("NoSuchKey")),
+		},
+		{
+			name: "conflict", want: false,
+			err: api.Wrap("complete", "/a", api.ErrConflict, errors.New("PreconditionFailed")),
+		},
+		{
+			name: "throttled", want: true,
+			err: api.Wrap("upload", "/a", api.ErrThrottled, errors.New("SlowDown")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_deadLetterJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-dead-letter")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := openDeadLetterJournal(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		err = j.Append(
+			&DeadLetter{Op: opUpload, Path: fmt.Sprintf("/data/%d", i), Attempts: 5, Error: "timeout"},
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	letters, err := DeadLetters(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 3 || letters[2].Path != "/data/2" {
+		t.Fatalf("DeadLetters() = %v, want 3 letters", letters)
+	}
+
+	// the letter of the same operation is replaced
+	err = j.Append(&DeadLetter{Op: opUpload, Path: "/data/1", Attempts: 6, Error: "timeout"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = j.Remove(opUpload, "/data/0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = j.Remove(opDelete, "/data/2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	letters, err = j.List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 2 || letters[0].Path != "/data/2" || letters[1].Attempts != 6 {
+		t.Errorf("List() = %v, want /data/2 and /data/1 of 6 attempts", letters)
+	}
+}
+
+func Test_server_replayDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-replay")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	conf := filepath.Join(dir, "conf")
+	err = os.MkdirAll(local, 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file := filepath.Join(local, "a.txt")
+	err = ioutil.WriteFile(file, []byte("aaaa"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	j, err := openDeadLetterJournal(conf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = j.Append(&DeadLetter{Op: opUpload, Path: file, Attempts: 5, Error: "timeout"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := memory.NewMemoryFileStorage()
+	opts := []Option{
+		OptionConfPath(conf), OptionRemotePrefix("backup"), OptionKeyTemplate("{relpath}"),
+	}
+
+	// the letter survives the server closed before the replayed operation is done, NewServer
+	// doesn't wait for the operations with the initial upload of the event loop
+	storage.SetFaults(memory.Faults{Latency: time.Hour})
+	s, err := NewServer(
+		context.Background(), local, storage, append(
+			opts, OptionWatcher(newFakeWatcher()), OptionInitUpload(true),
+			OptionWatchAfterInit(true),
+		)...,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.Close()
+	letters, err := j.List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 1 {
+		t.Fatalf("List() = %v, want the letter of the interrupted replay", letters)
+	}
+
+	storage.SetFaults(memory.Faults{})
+	s, err = NewServer(
+		context.Background(), local, storage, append(opts, OptionWatcher(newFakeWatcher()))...,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	eventually(
+		t, "the replayed letter is removed", func() bool {
+			letters, err := j.List()
+			return err == nil && len(letters) == 0
+		},
+	)
+	if _, err := storage.Info(context.Background(), "/backup/a.txt"); err != nil {
+		t.Errorf("Info() error = %v, want the replayed upload", err)
+	}
+}
+
+func TestDrainDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-drain")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	conf := filepath.Join(dir, "conf")
+	err = os.MkdirAll(local, 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file := filepath.Join(local, "a.txt")
+	err = ioutil.WriteFile(file, []byte("aaaa"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	j, err := openDeadLetterJournal(conf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = j.Append(&DeadLetter{Op: opUpload, Path: file, Attempts: 5, Error: "timeout"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := memory.NewMemoryFileStorage()
+	opts := []Option{
+		OptionConfPath(conf), OptionRemotePrefix("backup"), OptionKeyTemplate("{relpath}"),
+	}
+
+	// the letter is kept while the operation fails
+	storage.SetFaults(memory.Faults{ErrorRate: 1})
+	failed, err := DrainDeadLetters(context.Background(), local, storage, opts...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	letters, err := j.List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if failed != 1 || len(letters) != 1 || letters[0].Attempts != 6 {
+		t.Fatalf("DrainDeadLetters() = %v, letters: %v, want 1 letter of 6 attempts", failed, letters)
+	}
+
+	storage.SetFaults(memory.Faults{})
+	failed, err = DrainDeadLetters(context.Background(), local, storage, opts...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	letters, err = j.List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if failed != 0 || len(letters) != 0 {
+		t.Fatalf("DrainDeadLetters() = %v, letters: %v, want none", failed, letters)
+	}
+	if _, err := storage.Info(context.Background(), "/backup/a.txt"); err != nil {
+		t.Errorf("Info() error = %v, want the drained upload", err)
+	}
+}
@@ -2,15 +2,20 @@ package fsync
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/pjoc-team/fsync/pkg/storage/api"
-	"github.com/pjoc-team/threadpool"
 	"github.com/pjoc-team/tracing/logger"
 	"io"
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // const (
@@ -29,11 +34,35 @@ import (
 
 type server struct {
 	rootPath   string
+	hostname   string
+	keys       *keyTemplate
 	options    *foptions
 	storage    api.FileStorage
-	watcher    *fsnotify.Watcher
+	state      *stateStore
+	watcher    Watcher
+	debouncer  *debouncer
+	pipeline   *pipeline
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+	// dirs watched directories and their info when they are watched, nil if failed to stat
+	dirs      map[string]os.FileInfo
+	dirsMutex sync.Mutex
+	// pendingRename rename event waiting for the paired create event
+	pendingRename *renameEvent
+	// movedDirs old paths of the moved directories
+	movedDirs   map[string]struct{}
+	renameMutex sync.Mutex
+	// pendingDeletes delayed deletions
+	pendingDeletes map[string]*time.Timer
+	deleteMutex    sync.Mutex
+	// deadLetters journal of failed operations, nil if the conf path is empty
+	deadLetters *deadLetterJournal
+	ignorer     *ignorer
+	// rescan requests of immediate reconciliation
+	rescan chan struct{}
+	// checkpoints checkpoints of incomplete uploads
+	checkpoints *checkpointStore
+	closeOnce   sync.Once
 	// conf       *Config
 	// cs *config.Config
 }
@@ -41,30 +70,83 @@ type server struct {
 // NewServer create server
 func NewServer(
 	ctx context.Context, rootPath string, storage api.FileStorage, opts ...Option,
-) (_ SyncServer, err error) {
-	ctx, cancel := context.WithCancel(ctx)
+) (SyncServer, error) {
 	log := logger.ContextLog(ctx)
+	o, err := newFoptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = o.validate()
+	if err != nil {
+		log.Errorf("invalid options, error: %v", err.Error())
+		return nil, err
+	}
+	svr, err := newServer(ctx, rootPath, storage, &o)
+	if err != nil {
+		return nil, err
+	}
+	go svr.flushState()
+	if o.TwoWay && o.ConfPath == "" {
+		log.Warnf("the sync state of two-way mode is lost after restart without conf path")
+	}
+	svr.replayDeadLetters()
+	err = svr.AddPath(rootPath)
+	if err != nil {
+		log.Errorf("failed create watcher of file: %v, error: %v", rootPath, err.Error())
+	}
+	return svr, nil
+}
 
-	watcher, err2 := fsnotify.NewWatcher()
+// newServer open the stores under the conf path and create the server of the validated options,
+// nothing is started.
+func newServer(
+	ctx context.Context, rootPath string, storage api.FileStorage, o *foptions,
+) (_ *server, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	log := logger.ContextLog(ctx)
 	defer func() {
 		if err != nil {
 			cancel()
 		}
 	}()
+
+	hostname, err2 := os.Hostname()
 	if err2 != nil {
-		log.Errorf("failed create watcher error: %v", err2.Error())
-		cancel()
-		return nil, err2
+		hostname = "unknown"
+	}
+	keys, err := newKeyTemplate(o.RemotePrefix, o.KeyTemplate, hostname, o.JobName)
+	if err != nil {
+		log.Errorf("invalid key template, error: %v", err.Error())
+		return nil, err
+	}
+	if keys.dynamic && o.TwoWay {
+		return nil, fmt.Errorf(
+			"time variables of key template: %v don't support two-way sync", o.KeyTemplate,
+		)
 	}
 
-	o, err2 := newFoptions(opts...)
-	if err2 != nil {
-		err2 := watcher.Close()
-		if err2 != nil {
-			log.Errorf("failed to close watcher, error: %v", err2.Error())
-		}
-		cancel()
-		return nil, err2
+	state, err := openStateStore(stateFilePath(o.ConfPath, o.StorageName, keys.root))
+	if err != nil {
+		log.Errorf("failed to open state store, error: %v", err.Error())
+		return nil, err
+	}
+
+	checkpoints, err := openCheckpointStore(checkpointFilePath(o.ConfPath))
+	if err != nil {
+		log.Errorf("failed to open checkpoint store, error: %v", err.Error())
+		return nil, err
+	}
+
+	deadLetters, err := openDeadLetterJournal(o.ConfPath)
+	if err != nil {
+		log.Errorf("failed to open dead-letter journal, error: %v", err.Error())
+		return nil, err
+	}
+
+	watcher, err := newWatcher(o)
+	if err != nil {
+		log.Errorf("failed create watcher error: %v", err.Error())
+		return nil, err
 	}
 
 	// if o.ConfPath == "" {
@@ -85,30 +167,70 @@ func NewServer(
 	// }
 
 	svr := &server{
-		watcher:    watcher,
-		rootPath:   rootPath,
-		options:    &o,
-		storage:    storage,
-		ctx:        ctx,
-		cancelFunc: cancel,
+		watcher:        watcher,
+		rootPath:       rootPath,
+		hostname:       hostname,
+		keys:           keys,
+		options:        o,
+		storage:        storage,
+		state:          state,
+		checkpoints:    checkpoints,
+		ctx:            ctx,
+		cancelFunc:     cancel,
+		dirs:           make(map[string]os.FileInfo),
+		movedDirs:      make(map[string]struct{}),
+		pendingDeletes: make(map[string]*time.Timer),
+		deadLetters:    deadLetters,
+		ignorer:        newIgnorer(rootPath, o.IgnorePatterns, o.IncludePatterns),
+		rescan:         make(chan struct{}, 1),
 		// conf:       conf,
 		// cs:         cs,
 	}
-	err2 = svr.AddPath(rootPath)
-	if err2 != nil {
-		log.Errorf("failed create watcher of file: %v, error: %v", rootPath, err2.Error())
-	}
+	svr.pipeline = newPipeline(ctx, o.ThreadPoolSize, o.QueueSize, o.Limiter)
+	svr.debouncer = newDebouncer(o.DebounceWindow, o.DebounceMaxDelay, svr.submitUpload)
 	return svr, nil
 }
 
-// Start start server
+// Start start server, the initial upload without WatchAfterInit runs until it's done or the
+// server is closed
 func (s *server) Start() error {
-	if !s.options.InitUpload {
-		s.watchFile()
+	go s.janitorLoop()
+	if s.options.TwoWay {
+		go s.pollRemote()
+	}
+	if s.options.InitUpload && !s.options.WatchAfterInit {
+		// the initial upload runs here instead of NewServer, so the servers of all jobs are
+		// created and can be closed while it runs
+		s.initialUpload(s.rootPath)
+		return nil
+	}
+	// the initial upload covers the reconciliation on start
+	go s.reconcileLoop(!s.options.InitUpload)
+	if s.options.InitUpload {
+		go s.initialUpload(s.rootPath)
 	}
+	s.watchFile()
 	return nil
 }
 
+// initialUpload upload all files of the path while the event loop is running, the walk watches
+// every directory before listing it, and files uploaded by events are skipped by the state store
+func (s *server) initialUpload(path string) {
+	log := logger.ContextLog(s.ctx)
+	log.Infof("initial upload of path: %v", path)
+	start := time.Now()
+	err := s.walkDir(path, true)
+	if err != nil && s.ctx.Err() == nil {
+		log.Errorf("failed to walk path: %v, error: %v", path, err.Error())
+	}
+	s.pipeline.Wait()
+	if s.ctx.Err() != nil {
+		log.Infof("initial upload of path: %v is canceled", path)
+		return
+	}
+	log.Infof("initial upload of path: %v is done in %v", path, time.Since(start))
+}
+
 func (s *server) AddPath(path string) error {
 	log := logger.ContextLog(s.ctx)
 	log.Debugf("process path: %v", path)
@@ -120,47 +242,17 @@ func (s *server) AddPath(path string) error {
 			return err
 		}
 	}
-	err = s.watcher.Add(path)
+	err = s.watchDir(path)
 	if err != nil {
 		log.Errorf("failed create watcher of file: %v, error: %v", path, err.Error())
 		return err
 	}
-	pool, err := threadpool.NewPool(s.ctx, s.options.ThreadPoolSize)
-	if err != nil {
-		log.Errorf("failed to create ThreadPool, error: %v", err.Error())
-	}
-
-	wg := sync.WaitGroup{}
-
-	err = filepath.Walk(path, func(subPath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			err := s.watcher.Add(subPath)
-			if err != nil {
-				log.Errorf("failed to watch file: %v", subPath)
-			}
-			return nil
-		}
-		if !s.options.InitUpload {
-			return nil
-		}
-		if pool != nil {
-			wg.Add(1)
-			pool.Run(func() {
-				defer wg.Done()
-				err = s.uploadFile(subPath)
-				if err != nil {
-					log.Errorf("failed to upload file: %v", subPath)
-				}
-			})
-		} else {
-			err = s.uploadFile(subPath)
-			if err != nil {
-				log.Errorf("failed to upload file: %v", subPath)
-			}
-		}
+	if s.options.InitUpload {
+		// the initial upload is run by Start
 		return nil
-	})
-	wg.Wait()
+	}
+	err = s.walkDir(path, s.options.InitUpload)
+	s.pipeline.Wait()
 	if err != nil {
 		log.Errorf("failed create watcher of file: %v, error: %v", path, err.Error())
 		return err
@@ -176,9 +268,102 @@ func (s *server) AddPath(path string) error {
 	return nil
 }
 
-// Close close context
+// walkDir watch the directory and all sub directories, and submit uploads of all files if upload
+// is true
+func (s *server) walkDir(path string, upload bool) error {
+	log := logger.ContextLog(s.ctx)
+	return filepath.Walk(
+		path, func(subPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Errorf("failed to walk file: %v, error: %v", subPath, err.Error())
+				return nil
+			}
+			if s.ctx.Err() != nil {
+				return s.ctx.Err()
+			}
+			if isTempFile(subPath) || !syncable(info) || s.ignored(subPath, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				err := s.watchDir(subPath)
+				if err != nil {
+					log.Errorf("failed to watch file: %v", subPath)
+				}
+				return nil
+			}
+			if upload {
+				s.submitUpload(subPath)
+			}
+			return nil
+		},
+	)
+}
+
+// submitUpload submit the upload of the file to the pipeline
+func (s *server) submitUpload(file string) {
+	s.submitOperation(&operation{op: opUpload, file: file, attempt: 1})
+}
+
+// Close close context and the watcher, and wait for the running tasks. The watcher is closed here
+// because the event loop isn't started by the initial upload without WatchAfterInit.
 func (s *server) Close() {
-	s.cancelFunc()
+	s.closeOnce.Do(
+		func() {
+			s.cancelFunc()
+			s.debouncer.Stop()
+			s.stopDeletes()
+			s.pipeline.Close()
+			err := s.watcher.Close()
+			if err != nil {
+				logger.ContextLog(s.ctx).Errorf("failed to close watcher, error: %v", err.Error())
+			}
+			s.flush()
+		},
+	)
+}
+
+// watchDir add the directory to watcher and remember it with its info, which identifies the
+// directory after it's renamed
+func (s *server) watchDir(path string) error {
+	err := s.watcher.Add(path)
+	if err != nil {
+		return err
+	}
+	stat, _ := os.Lstat(path)
+	s.dirsMutex.Lock()
+	s.dirs[filepath.Clean(path)] = stat
+	s.dirsMutex.Unlock()
+	return nil
+}
+
+// watched returns true if the path is a watched directory
+func (s *server) watched(path string) bool {
+	s.dirsMutex.Lock()
+	defer s.dirsMutex.Unlock()
+	_, ok := s.dirs[filepath.Clean(path)]
+	return ok
+}
+
+// unwatchDir forget the directory and its sub directories, returns the info of the directory
+// when it was watched, and false if the path is not a watched directory.
+func (s *server) unwatchDir(path string) (os.FileInfo, bool) {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	s.dirsMutex.Lock()
+	defer s.dirsMutex.Unlock()
+	stat, isDir := s.dirs[path]
+	for dir := range s.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(s.dirs, dir)
+			// watches of removed directories are already released by fsnotify, but watches
+			// of renamed directories are still alive and report events with the old name.
+			_ = s.watcher.Remove(dir)
+		}
+	}
+	return stat, isDir
 }
 
 func (s *server) watchFile() {
@@ -186,41 +371,82 @@ func (s *server) watchFile() {
 	log.Infof("starting watch file")
 	for {
 		select {
-		case event := <-s.watcher.Events:
+		case event, ok := <-s.watcher.Events():
+			if !ok {
+				return
+			}
 			log.Debugf("get event: %v ", event)
 			file := event.Name
+			if file == "" || filepath.Clean(file) == filepath.Clean(s.rootPath) ||
+				isTempFile(file) {
+				// events of the root path, removed watches or temp files
+				continue
+			}
+			if filepath.Base(file) == ignoreFile {
+				s.ignorer.Reload(path.Dir(s.statePath(file)))
+			}
+			if s.ignoredEvent(file) {
+				log.Debugf("ignore event of file: %v", file)
+				continue
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create && s.pairRename(file) {
+				continue
+			}
+			s.flushRename()
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				s.cancelDelete(file)
+			}
 			if event.Op&fsnotify.Write == fsnotify.Write {
-				log.Infof("upload file: %v", file)
-				err := s.uploadFile(file)
-				if err != nil {
-					log.Errorf("failed to upload file: %v, error: %v", file, err.Error())
-					continue
-				}
+				log.Debugf("write file: %v", file)
+				s.debouncer.Touch(file)
 			} else if event.Op&fsnotify.Create == fsnotify.Create {
 				log.Infof("create file: %v", file)
-				err := s.uploadFile(file)
-				if err != nil {
-					log.Errorf("failed to upload file: %v, error: %v", file, err.Error())
-					continue
-				}
+				s.debouncer.Touch(file)
 			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
 				log.Infof("removed file: %v", file)
+				s.debouncer.Cancel(file)
+				_, isDir := s.unwatchDir(file)
+				s.removeFile(file, isDir)
+			} else if event.Op&fsnotify.Rename == fsnotify.Rename {
+				log.Infof("renamed file: %v", file)
+				s.debouncer.Cancel(file)
+				s.renameFile(file)
 			}
 
-
-		case err := <-s.watcher.Errors:
+		case err, ok := <-s.watcher.Errors():
+			if !ok {
+				return
+			}
 			log.Errorf("receive err: %v", err.Error())
+			if err == fsnotify.ErrEventOverflow {
+				log.Warnf("events are dropped, rescan path: %v", s.rootPath)
+				s.requestRescan()
+			}
 		case <-s.ctx.Done():
 			log.Warnf("closed watcher")
-			err := s.watcher.Close()
-			if err != nil {
-				log.Errorf("failed to close watcher, error: %v", err.Error())
-			}
 			return
 		}
 	}
 }
 
+// ignored returns true if the file is excluded by the ignore rules
+func (s *server) ignored(file string, isDir bool) bool {
+	return s.ignorer.Ignored(s.statePath(file), isDir)
+}
+
+// ignoredEvent returns true if the file of the event is ignored, removed files are checked as
+// directories if they are watched.
+func (s *server) ignoredEvent(file string) bool {
+	isDir := s.watched(file)
+	if stat, err := os.Lstat(file); err == nil {
+		if !syncable(stat) {
+			return true
+		}
+		isDir = stat.IsDir()
+	}
+	return s.ignored(file, isDir)
+}
+
 func (s *server) uploadFile(file string) error {
 	log := logger.ContextLog(s.ctx)
 	log.Println("upload file:", file)
@@ -229,54 +455,258 @@ func (s *server) uploadFile(file string) error {
 		log.Errorf("failed to open file: %v error: %v", file, err.Error())
 		return err
 	}
+	defer func() {
+		err2 := reader.Close()
+		if err2 != nil {
+			log.Errorf("failed close reader, error: %v", err2.Error())
+		}
+	}()
 	stat, err := reader.Stat()
 	if err != nil {
 		log.Errorf("failed to open file: %v error: %v", file, err.Error())
 		return err
 	}
 	if stat.IsDir() {
-		log.Debugf("file: %v is dir, skip upload", file)
-		err := s.AddPath(file)
+		log.Debugf("file: %v is dir, upload files of it", file)
+		// walk in another goroutine, workers must not block on submitting tasks
+		go func() {
+			err := s.walkDir(file, true)
+			if err != nil {
+				log.Errorf("failed to watch file: %v", file)
+			}
+		}()
+		return nil
+	}
+
+	key := s.statePath(file)
+	state, ok := s.state.Get(key)
+	if ok && state.unchanged(stat) {
+		log.Debugf("file: %v is unchanged, skip upload", file)
+		return nil
+	}
+	if ok && state.Size == stat.Size() {
+		hash, err := hashFile(file)
+		if err == nil && hash == state.Hash {
+			log.Debugf("content of file: %v is unchanged, skip upload", file)
+			state.ModTime = stat.ModTime()
+			s.state.Put(key, state)
+			return nil
+		}
+	}
+
+	if s.options.TwoWay {
+		resolved, err := s.resolveRemote(file, stat, state)
 		if err != nil {
-			log.Errorf("failed to watch file: %v", file)
+			log.Errorf("failed to get remote file of: %v, error: %v", file, err.Error())
+			return err
+		}
+		if resolved {
+			return nil
 		}
-		return nil
 	}
+	return s.putFile(file, reader, stat)
+}
 
-	absolutePath := strings.TrimPrefix(file, s.rootPath)
-	path := filepath.Join("/", absolutePath)
-	writer, err := s.storage.Create(s.ctx, path)
+// putFile upload the file and record its state
+func (s *server) putFile(file string, reader io.Reader, stat os.FileInfo) error {
+	log := logger.ContextLog(s.ctx)
+	path := s.remotePath(file)
+	hash, err := s.writeFile(path, reader)
 	if err != nil {
-		log.Errorf("failed to create file: %v error: %v", file, err.Error())
+		log.Errorf("failed to upload file: %v error: %v", file, err.Error())
 		return err
 	}
-	defer func() {
-		err2 := writer.Close()
-		if err2 != nil {
-			log.Errorf("failed close writer, error: %v", err2.Error())
-		}
-		err2 = reader.Close()
-		if err2 != nil {
-			log.Errorf("failed close reader, error: %v", err2.Error())
+	state := &fileState{
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		Hash:     hash,
+		Key:      path,
+		SyncedAt: time.Now(),
+	}
+	info, err := s.storage.Info(s.ctx, path)
+	if err != nil {
+		log.Warnf("failed to get info of file: %v error: %v", path, err.Error())
+	} else {
+		state.ETag = remoteVersion(info)
+	}
+	s.state.Put(s.statePath(file), state)
+	return nil
+}
+
+// writeFile write the reader to the storage, returns the hex encoded sha256 of the content
+func (s *server) writeFile(path string, reader io.Reader) (string, error) {
+	log := logger.ContextLog(s.ctx)
+	if f, ok := reader.(*os.File); ok {
+		if uploader, ok := s.storage.(api.Uploader); ok {
+			return s.uploadRanges(uploader, path, f)
 		}
-	}()
+	}
+	writer, err := s.storage.Create(s.ctx, path, s.checkpointOption(path), contentType(path))
+	if err != nil {
+		log.Errorf("failed to create file: %v error: %v", path, err.Error())
+		return "", err
+	}
+	h := sha256.New()
+	buf := make([]byte, 1024*1024)
 	for {
-		buf := make([]byte, 1024*1024)
 		n, err := reader.Read(buf)
 		if err != nil && err != io.EOF {
-			log.Errorf("failed to read file: %v error: %v", file, err.Error())
-			return err
+			log.Errorf("failed to read file: %v error: %v", path, err.Error())
+			abortWriter(writer)
+			s.dropCheckpoint(path)
+			return "", err
 		}
 		data := buf[:n]
+		h.Write(data)
 		_, err2 := writer.Write(data)
 		if err2 != nil {
 			log.Errorf("failed to write storage, error: %v", err2.Error())
-			return err2
+			abortWriter(writer)
+			return "", err2
 		}
 		if err == io.EOF {
-			return nil
+			break
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		log.Errorf("failed close writer, error: %v", err.Error())
+		return "", err
+	}
+	s.checkpoints.Delete(path)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadRanges upload the local file by the uploader which reads ranges of the file concurrently,
+// the file is hashed before the upload to record the sha256 with the file, the sha256 of the
+// state is reused if the file is unchanged. Returns the hex encoded sha256 of the content.
+func (s *server) uploadRanges(uploader api.Uploader, path string, f *os.File) (string, error) {
+	log := logger.ContextLog(s.ctx)
+	stat, err := f.Stat()
+	if err != nil {
+		log.Errorf("failed to stat file: %v error: %v", f.Name(), err.Error())
+		return "", err
+	}
+	size := stat.Size()
+	hash := ""
+	state, ok := s.state.Get(s.statePath(f.Name()))
+	if ok && state.Hash != "" && state.unchanged(stat) {
+		hash = state.Hash
+	} else {
+		h := sha256.New()
+		_, err = io.Copy(h, io.NewSectionReader(f, 0, size))
+		if err != nil {
+			log.Errorf("failed to read file: %v error: %v", f.Name(), err.Error())
+			s.dropCheckpoint(path)
+			return "", err
 		}
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+	err = uploader.Upload(
+		s.ctx, path, f, size, s.checkpointOption(path), api.WithSHA256(hash), contentType(path),
+	)
+	if err != nil {
+		log.Errorf("failed to upload file: %v error: %v", path, err.Error())
+		return "", err
 	}
+	s.checkpoints.Delete(path)
+	return hash, nil
+}
+
+// checkpointOption returns the option which resumes the upload of the path from the checkpoint
+// store, and saves the progress to it
+func (s *server) checkpointOption(path string) api.Option {
+	return api.WithCheckpoint(
+		s.checkpoints.Get(path), func(checkpoint *api.Checkpoint) {
+			s.checkpoints.Put(path, checkpoint)
+		},
+	)
+}
+
+// dropCheckpoint delete the checkpoint of the path in storage and abort its upload
+func (s *server) dropCheckpoint(path string) {
+	s.dropCheckpoints(
+		func(p string) bool {
+			return p == path
+		},
+	)
+}
+
+// dropCheckpoints delete the checkpoints of the paths in storage matched by fn and abort their
+// uploads, the uploads of deleted or dead-lettered files are never resumed and their parts
+// would be kept by the storage
+func (s *server) dropCheckpoints(fn func(path string) bool) {
+	removed := s.checkpoints.Remove(fn)
+	aborter, ok := s.storage.(api.CheckpointAborter)
+	if !ok {
+		return
+	}
+	for path, checkpoint := range removed {
+		err := aborter.AbortCheckpoint(s.ctx, path, checkpoint)
+		if err != nil {
+			logger.ContextLog(s.ctx).Errorf(
+				"failed to abort upload of file: %v, error: %v", path, err.Error(),
+			)
+		}
+	}
+}
+
+// dropFileCheckpoints drop the checkpoints of the local file or the files under the directory,
+// which may be uploaded to several keys if the key template contains time variables
+func (s *server) dropFileCheckpoints(file string, isDir bool) {
+	rel := s.statePath(file)
+	s.dropCheckpoints(
+		func(path string) bool {
+			r, ok := s.keys.rel(path)
+			return ok && (r == rel || isDir && strings.HasPrefix(r, rel+"/"))
+		},
+	)
+}
+
+// contentType returns the option of the content type guessed by the extension of the path
+func contentType(p string) api.Option {
+	return api.WithMimetype(mime.TypeByExtension(path.Ext(p)))
+}
+
+// abortWriter abort the writer if it's supported, otherwise close it. Resumable writers which
+// failed keep the uploaded parts, Abort of them is a no-op.
+func abortWriter(writer io.WriteCloser) {
+	if aborter, ok := writer.(api.Aborter); ok {
+		_ = aborter.Abort()
+		return
+	}
+	_ = writer.Close()
+}
+
+// remotePath returns the path in storage of the local file, files keep the key of the first
+// upload if the key template contains time variables
+func (s *server) remotePath(file string) string {
+	rel := s.statePath(file)
+	if state, ok := s.state.Get(rel); ok && state.Key != "" {
+		if r, ok := s.keys.rel(state.Key); ok && r == rel {
+			return state.Key
+		}
+	}
+	return s.keys.key(rel, time.Now())
+}
+
+// localPath returns the local file of the path in storage, returns false if the path isn't
+// produced by the key template or the file is out of the root path
+func (s *server) localPath(p string) (string, bool) {
+	rel, ok := s.keys.rel(p)
+	if !ok {
+		return "", false
+	}
+	file, err := localFile(s.rootPath, rel)
+	if err != nil {
+		return "", false
+	}
+	return file, true
+}
+
+// filePath returns the local file of the slash separated path relative to the root path
+func (s *server) filePath(rel string) string {
+	return filepath.Join(s.rootPath, filepath.FromSlash(rel))
 }
 
 // func (s *server) writeConfig() error {
@@ -0,0 +1,513 @@
+package fsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/fs"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+// fakeWatcher watcher which reports events sent by tests
+type fakeWatcher struct {
+	mutex  sync.Mutex
+	dirs   map[string]bool
+	events chan fsnotify.Event
+	errors chan error
+	closed bool
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{
+		dirs:   make(map[string]bool),
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+}
+
+func (f *fakeWatcher) Add(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dirs[filepath.Clean(path)] = true
+	return nil
+}
+
+func (f *fakeWatcher) Remove(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.dirs, filepath.Clean(path))
+	return nil
+}
+
+func (f *fakeWatcher) Events() <-chan fsnotify.Event {
+	return f.events
+}
+
+func (f *fakeWatcher) Errors() <-chan error {
+	return f.errors
+}
+
+func (f *fakeWatcher) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeWatcher) isClosed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.closed
+}
+
+func (f *fakeWatcher) watched(path string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.dirs[filepath.Clean(path)]
+}
+
+// countingStorage storage which counts the uploads of each path
+type countingStorage struct {
+	api.FileStorage
+	mutex   sync.Mutex
+	uploads map[string]int
+}
+
+func (c *countingStorage) Create(
+	ctx context.Context, path string, opts ...api.Option,
+) (io.WriteCloser, error) {
+	c.mutex.Lock()
+	c.uploads[path]++
+	c.mutex.Unlock()
+	return c.FileStorage.Create(ctx, path, opts...)
+}
+
+func (c *countingStorage) count(path string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.uploads[path]
+}
+
+// newTestServer create the server of the options by the constructor of NewServer with a fake
+// watcher, nothing is started and the server is closed at the end of the test
+func newTestServer(
+	t *testing.T, rootPath string, storage api.FileStorage, opts ...Option,
+) (*server, *fakeWatcher) {
+	t.Helper()
+	watcher := newFakeWatcher()
+	o, err := newFoptions(append(opts, OptionWatcher(watcher))...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = o.validate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := newServer(context.Background(), rootPath, storage, &o)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(s.Close)
+	return s, watcher
+}
+
+// tempDir create a temp directory which is removed at the end of the test
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fsync-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(
+		func() {
+			_ = os.RemoveAll(dir)
+		},
+	)
+	return dir
+}
+
+// eventually wait until the condition is true
+func eventually(t *testing.T, msg string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout: %v", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_server_watchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-server")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "remote")
+	err = os.MkdirAll(filepath.Join(local, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage, err := fs.NewLocalFileStorage(remote)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	watcher := newFakeWatcher()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServer(
+		ctx, local, storage, OptionWatcher(watcher), OptionDebounceWindow(0),
+		OptionDeletePolicy(DeletePolicyImmediate),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	if !watcher.watched(local) || !watcher.watched(filepath.Join(local, "sub")) {
+		t.Fatalf("directories are not watched: %v", watcher.dirs)
+	}
+	go func() {
+		_ = s.Start()
+	}()
+
+	exists := func(name string) func() bool {
+		return func() bool {
+			_, err := os.Stat(filepath.Join(remote, name))
+			return err == nil
+		}
+	}
+	file := filepath.Join(local, "a.txt")
+	err = ioutil.WriteFile(file, []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Create}
+	eventually(t, "created file is uploaded", exists("a.txt"))
+
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Remove}
+	eventually(
+		t, "removed file is deleted", func() bool {
+			return !exists("a.txt")()
+		},
+	)
+
+	// files changed while events are dropped are uploaded by the rescan
+	err = ioutil.WriteFile(filepath.Join(local, "b.txt"), []byte("b"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	watcher.errors <- fsnotify.ErrEventOverflow
+	eventually(t, "file is uploaded by the rescan", exists("b.txt"))
+}
+
+func Test_server_WatchAfterInit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-server")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	err = os.MkdirAll(local, 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		err = ioutil.WriteFile(filepath.Join(local, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	remote, err := fs.NewLocalFileStorage(filepath.Join(dir, "remote"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := &countingStorage{FileStorage: remote, uploads: make(map[string]int)}
+
+	watcher := newFakeWatcher()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServer(
+		ctx, local, storage, OptionWatcher(watcher), OptionDebounceWindow(0),
+		OptionInitUpload(true), OptionWatchAfterInit(true),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	if storage.count("/a.txt") != 0 {
+		t.Fatalf("files are uploaded before the event loop starts")
+	}
+	go func() {
+		_ = s.Start()
+	}()
+
+	// events of files which are uploaded by the walk are deduplicated
+	watcher.events <- fsnotify.Event{Name: filepath.Join(local, "a.txt"), Op: fsnotify.Write}
+	file := filepath.Join(local, "c.txt")
+	err = ioutil.WriteFile(file, []byte("c"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Create}
+	eventually(
+		t, "all files are uploaded", func() bool {
+			return storage.count("/a.txt") > 0 && storage.count("/b.txt") > 0 &&
+				storage.count("/c.txt") > 0
+		},
+	)
+	time.Sleep(100 * time.Millisecond)
+	for _, path := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		if n := storage.count(path); n != 1 {
+			t.Errorf("file: %v is uploaded %v times, want 1", path, n)
+		}
+	}
+}
+
+func Test_server_keyTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-server")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "remote")
+	err = os.MkdirAll(local, 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage, err := fs.NewLocalFileStorage(remote)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	watcher := newFakeWatcher()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServer(
+		ctx, local, storage, OptionWatcher(watcher), OptionDebounceWindow(0),
+		OptionDeletePolicy(DeletePolicyImmediate), OptionRemotePrefix("backup"),
+		OptionKeyTemplate("{hostname}/{job}/{yyyy}/{relpath}"), OptionJobName("logs"),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	go func() {
+		_ = s.Start()
+	}()
+
+	key := filepath.Join(
+		remote, "backup", hostname, "logs", time.Now().Format("2006"), "a.txt",
+	)
+	file := filepath.Join(local, "a.txt")
+	err = ioutil.WriteFile(file, []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Create}
+	eventually(
+		t, "file is uploaded to the key of the template", func() bool {
+			_, err := os.Stat(key)
+			return err == nil
+		},
+	)
+
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	watcher.events <- fsnotify.Event{Name: file, Op: fsnotify.Remove}
+	eventually(
+		t, "file of the key is deleted", func() bool {
+			_, err := os.Stat(key)
+			return os.IsNotExist(err)
+		},
+	)
+}
+
+func Test_server_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-server")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	storage, err := fs.NewLocalFileStorage(filepath.Join(dir, "remote"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the event loop isn't started by the initial upload without WatchAfterInit
+	watcher := newFakeWatcher()
+	s, err := NewServer(
+		context.Background(), filepath.Join(dir, "local"), storage, OptionWatcher(watcher),
+		OptionInitUpload(true),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.Close()
+	if !watcher.isClosed() {
+		t.Errorf("watcher isn't closed by Close()")
+	}
+}
+
+func Test_server_Start_initialUpload(t *testing.T) {
+	dir := tempDir(t)
+	err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := memory.NewMemoryFileStorage()
+	storage.SetFaults(memory.Faults{Latency: time.Hour})
+
+	// NewServer returns before the initial upload, which is run by Start until the server is
+	// closed
+	s, err := NewServer(
+		context.Background(), dir, storage, OptionWatcher(newFakeWatcher()),
+		OptionInitUpload(true),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Start() returns before the initial upload is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout: Start() returns after Close()")
+	}
+}
+
+// rangeStorage storage which uploads the ranges of the reader in reverse order, and records the
+// sha256 of the options
+type rangeStorage struct {
+	*memory.Storage
+	sha256 string
+}
+
+func (r *rangeStorage) Upload(
+	ctx context.Context, path string, reader io.ReaderAt, size int64, opts ...api.Option,
+) error {
+	o := api.NewOptions()
+	o.Apply(opts...)
+	r.sha256 = o.SHA256
+	data := make([]byte, size)
+	for offset := (size - 1) / 3 * 3; offset >= 0; offset -= 3 {
+		end := offset + 3
+		if end > size {
+			end = size
+		}
+		_, err := reader.ReadAt(data[offset:end], offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	w, err := r.Create(ctx, path, opts...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	return err
+}
+
+func Test_server_uploadRanges(t *testing.T) {
+	dir := tempDir(t)
+	file := filepath.Join(dir, "a.txt")
+	data := []byte("hello, world!")
+	err := ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	// the hash of the unchanged file is reused, changed files are hashed before the upload
+	tests := []struct {
+		name       string
+		state      *fileState
+		wantSHA256 string
+		want       string
+	}{
+		{name: "new", wantSHA256: hash, want: hash},
+		{
+			name:       "changed",
+			state:      &fileState{Size: stat.Size() + 1, ModTime: stat.ModTime(), Hash: "old"},
+			wantSHA256: hash, want: hash,
+		},
+		{
+			name:       "unchanged",
+			state:      &fileState{Size: stat.Size(), ModTime: stat.ModTime(), Hash: "state"},
+			wantSHA256: "state", want: "state",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				storage := &rangeStorage{Storage: memory.NewMemoryFileStorage()}
+				s, _ := newTestServer(t, dir, storage)
+				if tt.state != nil {
+					s.state.Put("a.txt", tt.state)
+				}
+				f, err := os.Open(file)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer f.Close()
+				got, err := s.uploadRanges(storage, "/a.txt", f)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if got != tt.want || storage.sha256 != tt.wantSHA256 {
+					t.Errorf(
+						"uploadRanges() = %v with sha256: %v, want %v with sha256: %v", got,
+						storage.sha256, tt.want, tt.wantSHA256,
+					)
+				}
+				if remote, _ := remoteData(storage.Storage, "/a.txt"); remote != string(data) {
+					t.Errorf("uploaded content = %v, want %v", remote, string(data))
+				}
+			},
+		)
+	}
+}
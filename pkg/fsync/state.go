@@ -0,0 +1,380 @@
+package fsync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// stateFilePrefix file name prefix of the state stores under the ConfPath
+	stateFilePrefix = "fsync-state-"
+	// stateFlushInterval interval of flushing the state store to disk
+	stateFlushInterval = 10 * time.Second
+	// stateCompactLines extra lines of the state file before it's rewritten
+	stateCompactLines = 1024
+)
+
+// fileState state of the synced file
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Hash sha256 of the file content
+	Hash string `json:"hash"`
+	// ETag version of the remote file, see remoteVersion
+	ETag string `json:"etag"`
+	// Key key of the file in storage
+	Key string `json:"key"`
+	// SyncedAt time of the last sync
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// unchanged returns true if the size and mtime are equal to the state
+func (f *fileState) unchanged(info os.FileInfo) bool {
+	return f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+}
+
+// remoteVersion returns the etag of the remote file, or the size and mtime if the storage
+// doesn't support etag
+func remoteVersion(info *api.FileInfo) string {
+	if info.ETag != "" {
+		return info.ETag
+	}
+	return fmt.Sprintf("%d-%d", info.Size, info.ModTime.UnixNano())
+}
+
+// stateStore state store of synced files keyed by the slash separated path relative to the
+// root path, it's kept in memory and flushed to the file. The file is a log of json lines, the
+// changed states are appended on flush, and the file is rewritten by the current states when
+// the log is much longer than them.
+type stateStore struct {
+	path  string
+	mutex sync.Mutex
+	files map[string]*fileState
+	// changes states changed since the last flush, nil for deleted states
+	changes map[string]*fileState
+	// logged lines in the file
+	logged int
+	// compact rewrite the file on the next flush, such as the file has a torn line of a crash
+	compact    bool
+	flushMutex sync.Mutex
+}
+
+// stateEntry line of the state file, the state is nil if it's deleted
+type stateEntry struct {
+	Path  string     `json:"path"`
+	State *fileState `json:"state,omitempty"`
+}
+
+// openStateStore open the state store of the file, the store is memory only if path is empty
+func openStateStore(path string) (*stateStore, error) {
+	s := &stateStore{
+		path:    path,
+		files:   make(map[string]*fileState),
+		changes: make(map[string]*fileState),
+	}
+	if path == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		s.logged++
+		entry := &stateEntry{}
+		err = json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil || entry.Path == "" {
+			// a torn line of a crash, appending after it would tear the next line
+			s.compact = true
+			continue
+		}
+		if entry.State == nil {
+			delete(s.files, entry.Path)
+		} else {
+			s.files[entry.Path] = entry.State
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get get the state of the path
+func (s *stateStore) Get(path string) (*fileState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[path]
+	if !ok {
+		return nil, false
+	}
+	state := *f
+	return &state, true
+}
+
+// Put save the state of the path
+func (s *stateStore) Put(path string, state *fileState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[path] = state
+	s.changes[path] = state
+}
+
+// Delete delete the state of the path
+func (s *stateStore) Delete(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.files[path]; ok {
+		delete(s.files, path)
+		s.changes[path] = nil
+	}
+}
+
+// DeleteDir delete the states of all files under the dir
+func (s *stateStore) DeleteDir(dir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prefix := dir + "/"
+	for path := range s.files {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.files, path)
+			s.changes[path] = nil
+		}
+	}
+}
+
+// Range call fn for the states of all files, the store is locked during ranging
+func (s *stateStore) Range(fn func(path string, state *fileState)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for path, f := range s.files {
+		state := *f
+		fn(path, &state)
+	}
+}
+
+// Rename move the state of the path to the new path
+func (s *stateStore) Rename(from string, to string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f, ok := s.files[from]; ok {
+		delete(s.files, from)
+		s.files[to] = f
+		s.changes[from] = nil
+		s.changes[to] = f
+	}
+}
+
+// Flush append the changed states to the file and sync it to the disk, the file is rewritten
+// atomically if the log is longer than twice of the states
+func (s *stateStore) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	s.mutex.Lock()
+	if len(s.changes) == 0 && !s.compact {
+		s.mutex.Unlock()
+		return nil
+	}
+	changes := s.changes
+	s.changes = make(map[string]*fileState)
+	compact := s.compact || s.logged+len(changes) > 2*len(s.files)+stateCompactLines
+	entries := changes
+	if compact {
+		entries = s.files
+	}
+	data, err := marshalStates(entries)
+	s.mutex.Unlock()
+
+	if err == nil && compact {
+		err = writeFileAtomic(s.path, data)
+	} else if err == nil {
+		err = appendFile(s.path, data)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		// keep the changes which are not changed again for the next flush
+		for path, state := range changes {
+			if _, ok := s.changes[path]; !ok {
+				s.changes[path] = state
+			}
+		}
+		// the appended lines may be torn
+		s.compact = true
+		return err
+	}
+	if compact {
+		s.logged = len(entries)
+		s.compact = false
+	} else {
+		s.logged += len(entries)
+	}
+	return nil
+}
+
+// marshalStates returns the json lines of the states
+func marshalStates(states map[string]*fileState) ([]byte, error) {
+	data := make([]byte, 0)
+	for path, state := range states {
+		line, err := json.Marshal(&stateEntry{Path: path, State: state})
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
+
+// appendFile append the data to the file and sync it to the disk
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// writeFileAtomic replace the file by the data atomically, the data and the rename are synced to
+// the disk before it returns
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir sync the directory to persist the renamed entries, directories can't be synced on
+// windows where renames are durable
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	err2 := d.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// stateFilePath returns the path of the state file of the storage and remote root under the conf
+// path, the state store is memory only if conf path is empty. States of other storages or roots
+// never describe the remote files, two-way sync would remove local files by them.
+func stateFilePath(confPath string, storageName string, root string) string {
+	if confPath == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(storageName + "\n" + root))
+	return filepath.Join(confPath, stateFilePrefix+hex.EncodeToString(sum[:8])+".jsonl")
+}
+
+// hashFile returns the hex encoded sha256 of the file
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// statePath returns the key of the local file in the state store
+func (s *server) statePath(file string) string {
+	rel, err := filepath.Rel(s.rootPath, file)
+	if err != nil {
+		rel = strings.TrimPrefix(file, s.rootPath)
+	}
+	return strings.TrimPrefix(filepath.ToSlash(rel), "/")
+}
+
+// flushState flush the state store and the checkpoint store periodically until the server is
+// closed
+func (s *server) flushState() {
+	ticker := time.NewTicker(stateFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// flush flush the state store and the checkpoint store
+func (s *server) flush() {
+	log := logger.ContextLog(s.ctx)
+	err := s.state.Flush()
+	if err != nil {
+		log.Errorf("failed to flush state, error: %v", err.Error())
+	}
+	err = s.checkpoints.Flush()
+	if err != nil {
+		log.Errorf("failed to flush checkpoints, error: %v", err.Error())
+	}
+}
@@ -0,0 +1,147 @@
+package fsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_stateStore_Flush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-state")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := stateFilePath(dir, "", "/")
+	s, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	modTime := time.Unix(1600000000, 0).UTC()
+	s.Put("a/b.txt", &fileState{Size: 1, ModTime: modTime, Hash: "h1", ETag: "e1"})
+	s.Put("a/c.txt", &fileState{Size: 2, ModTime: modTime, Hash: "h2"})
+	s.Put("d.txt", &fileState{Size: 3, ModTime: modTime, Hash: "h3"})
+	s.Rename("d.txt", "e.txt")
+	s.DeleteDir("a")
+	s.Put("a/f.txt", &fileState{Size: 4, ModTime: modTime, Hash: "h4"})
+	err = s.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s2, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		path   string
+		wantOk bool
+		want   string
+	}{
+		{path: "a/b.txt", wantOk: false},
+		{path: "a/c.txt", wantOk: false},
+		{path: "d.txt", wantOk: false},
+		{path: "e.txt", wantOk: true, want: "h3"},
+		{path: "a/f.txt", wantOk: true, want: "h4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := s2.Get(tt.path)
+			if ok != tt.wantOk {
+				t.Fatalf("Get() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && (got.Hash != tt.want || !got.ModTime.Equal(modTime)) {
+				t.Errorf("Get() = %#v, want hash %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_stateStore_Flush_log(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-state")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := stateFilePath(dir, "", "/")
+	s, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	modTime := time.Unix(1600000000, 0).UTC()
+	s.Put("a.txt", &fileState{Size: 1, ModTime: modTime, Hash: "h1"})
+	s.Put("b.txt", &fileState{Size: 2, ModTime: modTime, Hash: "h2"})
+	err = s.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// only the changed state is appended
+	s.Put("a.txt", &fileState{Size: 1, ModTime: modTime, Hash: "h3"})
+	err = s.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := countLines(t, path); got != 3 {
+		t.Fatalf("lines = %v, want 3", got)
+	}
+
+	// a torn line of a crash is skipped and the file is rewritten on the next flush
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = f.WriteString(`{"path":"c.txt","sta`)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s2, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, ok := s2.Get("a.txt"); !ok || got.Hash != "h3" {
+		t.Fatalf("Get() = %#v, %v, want hash h3", got, ok)
+	}
+	err = s2.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := countLines(t, path); got != 2 {
+		t.Fatalf("lines = %v, want 2", got)
+	}
+
+	// the log is compacted when it's much longer than the states
+	for i := 0; i < 2*stateCompactLines; i++ {
+		s2.Put("a.txt", &fileState{Size: int64(i), ModTime: modTime, Hash: "h4"})
+		err = s2.Flush()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got := countLines(t, path); got > stateCompactLines {
+		t.Fatalf("lines = %v, want compacted", got)
+	}
+	s3, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, ok := s3.Get("a.txt"); !ok || got.Size != 2*stateCompactLines-1 {
+		t.Fatalf("Get() = %#v, %v, want size %v", got, ok, 2*stateCompactLines-1)
+	}
+	if _, ok := s3.Get("b.txt"); !ok {
+		t.Fatal("Get() of b.txt is missing")
+	}
+}
+
+// countLines returns the lines of the file
+func countLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return bytes.Count(data, []byte("\n"))
+}
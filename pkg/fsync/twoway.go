@@ -0,0 +1,273 @@
+package fsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+const (
+	// defaultRemotePollInterval default interval of polling remote changes in two-way mode
+	defaultRemotePollInterval = time.Minute
+	// conflictTimeFormat time format of the conflict file suffix
+	conflictTimeFormat = "20060102150405"
+)
+
+// ConflictPolicy policy of resolving files changed on both sides since the last sync
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyNewest keep the file with the newer mtime
+	ConflictPolicyNewest ConflictPolicy = "newest"
+	// ConflictPolicyLocal keep the local file
+	ConflictPolicyLocal ConflictPolicy = "local"
+	// ConflictPolicyKeepBoth keep the remote file, and keep the local file with the
+	// .conflict-<host>-<ts> suffix
+	ConflictPolicyKeepBoth ConflictPolicy = "keep-both"
+)
+
+// ParseConflictPolicy parse conflict policy, empty string means ConflictPolicyNewest
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(policy); p {
+	case "":
+		return ConflictPolicyNewest, nil
+	case ConflictPolicyNewest, ConflictPolicyLocal, ConflictPolicyKeepBoth:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy: %v", policy)
+}
+
+// pollRemote pull remote changes periodically until the server is closed
+func (s *server) pollRemote() {
+	interval := s.options.RemotePollInterval
+	if interval <= 0 {
+		interval = defaultRemotePollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.pullRemote()
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// pullRemote download remote files changed since the last sync, and remove local files which
+// are removed remotely
+func (s *server) pullRemote() {
+	log := logger.ContextLog(s.ctx)
+	log.Debugf("pull remote changes")
+	start := time.Now()
+	seen := make(map[string]struct{})
+	err := api.Walk(
+		s.ctx, s.storage, s.keys.root, func(info *api.FileInfo) error {
+			file, ok := s.localPath(info.Path)
+			if !ok {
+				return s.ctx.Err()
+			}
+			seen[s.statePath(file)] = struct{}{}
+			s.pipeline.Submit(
+				&task{
+					path: file,
+					op:   opDownload,
+					fn: func() {
+						s.pullFile(info)
+					},
+				},
+			)
+			return s.ctx.Err()
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to list remote files, error: %v", err.Error())
+		return
+	}
+	s.pullDeletions(seen, start)
+}
+
+// pullFile download the remote file if it's changed since the last sync
+func (s *server) pullFile(info *api.FileInfo) {
+	log := logger.ContextLog(s.ctx)
+	file, ok := s.localPath(info.Path)
+	if !ok || isTempFile(file) || s.ignored(file, false) {
+		return
+	}
+	key := s.statePath(file)
+	state, ok := s.state.Get(key)
+	if ok && state.ETag == remoteVersion(info) {
+		return
+	}
+	stat, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		s.download(info, file)
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to stat file: %v, error: %v", file, err.Error())
+		return
+	}
+	if stat.IsDir() {
+		log.Warnf("remote file: %v is a local directory, skip download", info.Path)
+		return
+	}
+	if ok && state.unchanged(stat) {
+		s.download(info, file)
+		return
+	}
+	s.resolveConflict(file, stat, info)
+}
+
+// pullDeletions remove local files which are synced before the listing started, unchanged
+// since then, and not found in the listing. Files synced to keys out of the remote root are
+// never removed, the listing doesn't cover them.
+func (s *server) pullDeletions(seen map[string]struct{}, start time.Time) {
+	if s.options.DeletePolicy == DeletePolicyNever {
+		return
+	}
+	log := logger.ContextLog(s.ctx)
+	removed := make([]string, 0)
+	s.state.Range(
+		func(path string, state *fileState) {
+			if _, ok := seen[path]; ok || state.SyncedAt.After(start) {
+				return
+			}
+			if rel, ok := s.keys.rel(state.Key); !ok || rel != path {
+				return
+			}
+			file := s.filePath(path)
+			stat, err := os.Stat(file)
+			if err == nil && !state.unchanged(stat) {
+				return
+			}
+			removed = append(removed, path)
+		},
+	)
+	for _, path := range removed {
+		file := s.filePath(path)
+		log.Infof("remove file: %v which is removed remotely", file)
+		s.state.Delete(path)
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove file: %v, error: %v", file, err.Error())
+		}
+	}
+}
+
+// resolveRemote resolve the conflict if the remote file is changed since the last sync before
+// uploading the local file, returns false if the local file should be uploaded. The error of
+// getting the remote file is returned unless it doesn't exist, the upload is retried later.
+func (s *server) resolveRemote(file string, stat os.FileInfo, state *fileState) (bool, error) {
+	info, err := s.storage.Info(s.ctx, s.remotePath(file))
+	if errors.Is(err, api.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if state != nil && state.ETag == remoteVersion(info) {
+		return false, nil
+	}
+	s.resolveConflict(file, stat, info)
+	return true, nil
+}
+
+// resolveConflict resolve the file changed on both sides by the ConflictPolicy
+func (s *server) resolveConflict(file string, stat os.FileInfo, info *api.FileInfo) {
+	log := logger.ContextLog(s.ctx)
+	if identical(file, stat, info, int64(s.options.BufferSize)) {
+		state, err := identicalState(file, stat, info)
+		if err != nil {
+			log.Errorf("failed to hash file: %v, error: %v", file, err.Error())
+			return
+		}
+		s.state.Put(s.statePath(file), state)
+		return
+	}
+
+	log.Warnf("file: %v is changed on both sides, resolve by: %v", file, s.options.ConflictPolicy)
+	switch s.options.ConflictPolicy {
+	case ConflictPolicyLocal:
+		s.upload(file)
+	case ConflictPolicyKeepBoth:
+		conflict := fmt.Sprintf(
+			"%s.conflict-%s-%s", file, s.hostname, time.Now().Format(conflictTimeFormat),
+		)
+		err := copyFile(file, conflict)
+		if err != nil {
+			log.Errorf("failed to copy file: %v to: %v, error: %v", file, conflict, err.Error())
+			return
+		}
+		s.download(info, file)
+		s.runOperation(&operation{op: opUpload, file: conflict, attempt: 1})
+	default:
+		if info.ModTime.After(stat.ModTime()) {
+			s.download(info, file)
+		} else {
+			s.upload(file)
+		}
+	}
+}
+
+// upload upload the local file without checking the state
+func (s *server) upload(file string) {
+	log := logger.ContextLog(s.ctx)
+	reader, err := os.Open(file)
+	if err != nil {
+		log.Errorf("failed to open file: %v error: %v", file, err.Error())
+		return
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	stat, err := reader.Stat()
+	if err != nil {
+		log.Errorf("failed to stat file: %v error: %v", file, err.Error())
+		return
+	}
+	err = s.putFile(file, reader, stat)
+	if err != nil {
+		log.Errorf("failed to upload file: %v error: %v", file, err.Error())
+	}
+}
+
+// download download the remote file to the local file
+func (s *server) download(info *api.FileInfo, file string) {
+	log := logger.ContextLog(s.ctx)
+	log.Infof("download file: %v", file)
+	err := downloadFile(s.ctx, s.storage, s.state, s.statePath(file), info, file)
+	if errors.Is(err, api.ErrNotExist) {
+		log.Infof("remote file: %v is removed before downloading", info.Path)
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to download file: %v, error: %v", info.Path, err.Error())
+	}
+}
+
+func copyFile(src string, dst string) error {
+	reader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	writer, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	err2 := writer.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
@@ -0,0 +1,102 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+// infoErrorStorage storage which fails to get the info of files
+type infoErrorStorage struct {
+	*memory.Storage
+	err error
+}
+
+func (i *infoErrorStorage) Info(ctx context.Context, path string) (*api.FileInfo, error) {
+	return nil, i.err
+}
+
+func Test_server_pullDeletions(t *testing.T) {
+	local := tempDir(t)
+	s, _ := newTestServer(
+		t, local, memory.NewMemoryFileStorage(), OptionTwoWay(true), OptionRemotePrefix("backup"),
+		OptionDeletePolicy(DeletePolicyImmediate),
+	)
+	keys := map[string]string{
+		"a.txt": "/backup/a.txt",
+		// synced with another prefix
+		"b.txt": "/other/b.txt",
+		// the key isn't recorded
+		"c.txt": "",
+	}
+	for name, key := range keys {
+		file := filepath.Join(local, name)
+		err := ioutil.WriteFile(file, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		stat, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		s.state.Put(
+			name, &fileState{
+				Size: stat.Size(), ModTime: stat.ModTime(), Key: key,
+				SyncedAt: time.Now().Add(-time.Hour),
+			},
+		)
+	}
+
+	s.pullDeletions(map[string]struct{}{}, time.Now())
+	for name, key := range keys {
+		_, err := os.Stat(filepath.Join(local, name))
+		if removed := os.IsNotExist(err); removed != (key == "/backup/a.txt") {
+			t.Errorf("file: %v of key: %q is removed: %v", name, key, removed)
+		}
+	}
+}
+
+func Test_server_resolveRemote(t *testing.T) {
+	local := tempDir(t)
+	file := filepath.Join(local, "a.txt")
+	err := ioutil.WriteFile(file, []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "not exist", err: api.Wrap("info", "/a.txt", api.ErrNotExist, os.ErrNotExist)},
+		{
+			name: "throttled", wantErr: true,
+			err: api.Wrap("info", "/a.txt", api.ErrThrottled, errors.New("SlowDown")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				storage := &infoErrorStorage{Storage: memory.NewMemoryFileStorage(), err: tt.err}
+				s, _ := newTestServer(t, local, storage, OptionTwoWay(true))
+				resolved, err := s.resolveRemote(file, stat, nil)
+				if resolved || (err != nil) != tt.wantErr {
+					t.Errorf(
+						"resolveRemote() = %v, %v, want false, wantErr %v", resolved, err, tt.wantErr,
+					)
+				}
+			},
+		)
+	}
+}
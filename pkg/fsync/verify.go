@@ -0,0 +1,238 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/threadpool"
+	"github.com/pjoc-team/tracing/logger"
+)
+
+// verifyResult result of verifying a local file
+type verifyResult int
+
+const (
+	// verifyMatched the remote file has the same checksum
+	verifyMatched verifyResult = iota
+	// verifyMismatched the remote file has a different size or checksum
+	verifyMismatched
+	// verifyUnknown the remote file has no checksum comparable with the local file
+	verifyUnknown
+)
+
+type verifier struct {
+	ctx      context.Context
+	rootPath string
+	storage  api.FileStorage
+	options  *foptions
+	state    *stateStore
+	keys     *keyTemplate
+	ignorer  *ignorer
+}
+
+// Verify re-hash the local files under the root path and compare them with the checksums
+// recorded in storage, the remote content is not downloaded. The etag is compared, and the
+// sha256 recorded with the file if the etag differs. It returns an error if any file is missing
+// or different in storage.
+func Verify(ctx context.Context, rootPath string, storage api.FileStorage, opts ...Option) error {
+	o, err := newFoptions(opts...)
+	if err != nil {
+		return err
+	}
+	v, err := newVerifier(ctx, rootPath, storage, &o)
+	if err != nil {
+		return err
+	}
+	return v.verify()
+}
+
+// newVerifier create the verifier of the options with the state store under the conf path
+func newVerifier(
+	ctx context.Context, rootPath string, storage api.FileStorage, o *foptions,
+) (*verifier, error) {
+	log := logger.ContextLog(ctx)
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	keys, err := newKeyTemplate(o.RemotePrefix, o.KeyTemplate, hostname, o.JobName)
+	if err != nil {
+		return nil, err
+	}
+	state, err := openStateStore(stateFilePath(o.ConfPath, o.StorageName, keys.root))
+	if err != nil {
+		log.Errorf("failed to open state store, error: %v", err.Error())
+		return nil, err
+	}
+	return &verifier{
+		ctx:      ctx,
+		rootPath: rootPath,
+		storage:  storage,
+		options:  o,
+		state:    state,
+		keys:     keys,
+		ignorer:  newIgnorer(rootPath, o.IgnorePatterns, o.IncludePatterns),
+	}, nil
+}
+
+func (v *verifier) verify() error {
+	log := logger.ContextLog(v.ctx)
+	log.Infof("verify files of path: %v with prefix: %v", v.rootPath, v.keys.root)
+	remote := make(map[string]*api.FileInfo)
+	err := api.Walk(
+		v.ctx, v.storage, v.keys.root, func(info *api.FileInfo) error {
+			rel, ok := v.keys.rel(info.Path)
+			if ok && preferred(v.state, rel, info, remote[rel]) {
+				remote[rel] = info
+			}
+			return v.ctx.Err()
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to list remote files, error: %v", err.Error())
+		return err
+	}
+
+	size := v.options.ThreadPoolSize
+	if size <= 0 {
+		size = 1
+	}
+	pool, err := threadpool.NewPool(v.ctx, size)
+	if err != nil {
+		log.Errorf("failed to create ThreadPool, error: %v", err.Error())
+		return err
+	}
+	wg := sync.WaitGroup{}
+	var total, missing, mismatched, unknown, failed int64
+	err = filepath.Walk(
+		v.rootPath, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Errorf("failed to walk file: %v, error: %v", file, err.Error())
+				return nil
+			}
+			if v.ctx.Err() != nil {
+				return v.ctx.Err()
+			}
+			rel := v.rel(file)
+			if isTempFile(file) || !syncable(info) || v.ignorer.Ignored(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			total++
+			r, ok := remote[rel]
+			if !ok {
+				log.Warnf("file: %v is missing in storage", file)
+				missing++
+				return nil
+			}
+			wg.Add(1)
+			pool.Run(
+				func() {
+					defer wg.Done()
+					result, err := v.verifyFile(file, r)
+					switch {
+					case errors.Is(err, api.ErrNotExist):
+						log.Warnf("file: %v is missing in storage", file)
+						atomic.AddInt64(&missing, 1)
+					case err != nil:
+						log.Errorf("failed to verify file: %v, error: %v", file, err.Error())
+						atomic.AddInt64(&failed, 1)
+					case result == verifyMismatched:
+						log.Errorf("file: %v is different from: %v in storage", file, r.Path)
+						atomic.AddInt64(&mismatched, 1)
+					case result == verifyUnknown:
+						log.Warnf("file: %v has no comparable checksum in storage", file)
+						atomic.AddInt64(&unknown, 1)
+					}
+				},
+			)
+			return nil
+		},
+	)
+	wg.Wait()
+	if err != nil {
+		log.Errorf("failed to walk path: %v, error: %v", v.rootPath, err.Error())
+		return err
+	}
+	log.Infof(
+		"verified files: %v, missing: %v, mismatched: %v, unverifiable: %v, failed: %v", total,
+		missing, mismatched, unknown, failed,
+	)
+	if bad := missing + mismatched + failed; bad > 0 {
+		return fmt.Errorf("failed to verify %d of %d files", bad, total)
+	}
+	return nil
+}
+
+// verifyFile compare the local file with the listed remote file, the etag is compared first.
+// The sha256 recorded with the file is only read by Info if the etag differs, e.g. multipart
+// etags of another part size, or etags of encrypted objects which aren't the md5.
+func (v *verifier) verifyFile(file string, remote *api.FileInfo) (verifyResult, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return verifyUnknown, err
+	}
+	if stat.Size() != remote.Size {
+		return verifyMismatched, nil
+	}
+	etag := ""
+	if remote.ETag != "" {
+		etag, err = localETag(
+			file, api.PartSize(stat.Size(), int64(v.options.BufferSize)), remote.ETag,
+		)
+		if err != nil {
+			return verifyUnknown, err
+		}
+		if etag == remote.ETag {
+			return verifyMatched, nil
+		}
+	}
+	info, err := v.storage.Info(v.ctx, remote.Path)
+	if err != nil {
+		return verifyUnknown, err
+	}
+	if info.SHA256 != "" {
+		hash, err := hashFile(file)
+		if err != nil {
+			return verifyUnknown, err
+		}
+		if hash != info.SHA256 {
+			return verifyMismatched, nil
+		}
+		return verifyMatched, nil
+	}
+	if etag == "" || partCount(etag) != partCount(remote.ETag) {
+		return verifyUnknown, nil
+	}
+	return verifyMismatched, nil
+}
+
+// rel returns the slash separated path of the file relative to the root path
+func (v *verifier) rel(file string) string {
+	rel, err := filepath.Rel(v.rootPath, file)
+	if err != nil {
+		rel = strings.TrimPrefix(file, v.rootPath)
+	}
+	return strings.TrimPrefix(filepath.ToSlash(rel), "/")
+}
+
+// partCount returns the part count suffix of the multipart etag, empty for other etags
+func partCount(etag string) string {
+	index := strings.LastIndex(etag, "-")
+	if index < 0 {
+		return ""
+	}
+	return etag[index+1:]
+}
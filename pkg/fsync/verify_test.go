@@ -0,0 +1,185 @@
+package fsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/backend/memory"
+)
+
+// etagStorage storage which doesn't record the sha256 of files unless sha256 is set, it counts
+// the calls of Info
+type etagStorage struct {
+	*memory.Storage
+	sha256 bool
+	infos  int64
+}
+
+func (e *etagStorage) Info(ctx context.Context, path string) (*api.FileInfo, error) {
+	atomic.AddInt64(&e.infos, 1)
+	info, err := e.Storage.Info(ctx, path)
+	if err == nil {
+		if !e.sha256 {
+			info.SHA256 = ""
+		}
+	}
+	return info, err
+}
+
+// writeRemote write the file to storage
+func writeRemote(t *testing.T, storage api.FileStorage, path string, data []byte) {
+	writer, err := storage.Create(context.Background(), path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-verify")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{"a.txt": "aaaa", "b.txt": "bbbb", "c.txt": "cccc"}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	opts := []Option{OptionRemotePrefix("backup"), OptionKeyTemplate("{relpath}")}
+
+	tests := []struct {
+		name    string
+		remote  map[string]string
+		etag    bool
+		wantErr bool
+	}{
+		{
+			name:   "matched",
+			remote: files,
+		},
+		{
+			name:   "matched by etag",
+			remote: files,
+			etag:   true,
+		},
+		{
+			name:    "mismatched",
+			remote:  map[string]string{"a.txt": "aaaa", "b.txt": "bbbx", "c.txt": "cccc"},
+			wantErr: true,
+		},
+		{
+			name:    "mismatched by etag",
+			remote:  map[string]string{"a.txt": "aaaa", "b.txt": "bbbx", "c.txt": "cccc"},
+			etag:    true,
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			remote:  map[string]string{"a.txt": "aaaa", "b.txt": "bbbb"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				var storage api.FileStorage = memory.NewMemoryFileStorage()
+				if tt.etag {
+					storage = &etagStorage{Storage: storage.(*memory.Storage)}
+				}
+				for name, content := range tt.remote {
+					writeRemote(t, storage, "/backup/"+name, []byte(content))
+				}
+				err := Verify(context.Background(), dir, storage, opts...)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			},
+		)
+	}
+}
+
+func Test_verifier_verifyFile_partSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-verify")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.bin")
+	data := bytes.Repeat([]byte("a"), 1024)
+	err = ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	etag, err := localETag(file, 512, "-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := &etagStorage{Storage: memory.NewMemoryFileStorage()}
+	writeRemote(t, storage, "/a.bin", data)
+	o, err := newFoptions(OptionBufferSize(512))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v, err := newVerifier(context.Background(), dir, storage, &o)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the memory backend records the md5 etag, uploads in parts of 512 bytes are matched
+	// by the multipart etag. The sha256 is only read if the listed etag differs.
+	md5 := "c9a34cfc85d982698c6ac89f76071abd"
+	tests := []struct {
+		name      string
+		etag      string
+		sha256    bool
+		want      verifyResult
+		wantInfos int64
+	}{
+		{name: "md5", etag: md5, want: verifyMatched},
+		{name: "multipart", etag: etag, want: verifyMatched},
+		{name: "other part size", etag: "0123-3", want: verifyUnknown, wantInfos: 1},
+		{name: "different content", etag: "0123-2", want: verifyMismatched, wantInfos: 1},
+		{name: "sha256", etag: "0123-3", sha256: true, want: verifyMatched, wantInfos: 1},
+		{name: "no etag", sha256: true, want: verifyMatched, wantInfos: 1},
+		{name: "no checksum", want: verifyUnknown, wantInfos: 1},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				storage.sha256 = tt.sha256
+				storage.infos = 0
+				remote := &api.FileInfo{Path: "/a.bin", Size: int64(len(data)), ETag: tt.etag}
+				got, err := v.verifyFile(file, remote)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if got != tt.want {
+					t.Errorf("verifyFile() = %v, want %v", got, tt.want)
+				}
+				if storage.infos != tt.wantInfos {
+					t.Errorf("Info() calls = %v, want %v", storage.infos, tt.wantInfos)
+				}
+			},
+		)
+	}
+	got, err := v.verifyFile(file, &api.FileInfo{Path: "/a.bin", Size: 1, ETag: md5})
+	if err != nil || got != verifyMismatched {
+		t.Errorf("verifyFile() of other size = %v, error = %v, want mismatched", got, err)
+	}
+}
@@ -0,0 +1,296 @@
+package fsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// defaultPollInterval default interval of scanning watched directories by the poll watcher
+	defaultPollInterval = 5 * time.Second
+)
+
+// Watcher watches directories and reports events of their direct entries, like fsnotify
+type Watcher interface {
+	// Add watch the directory
+	Add(path string) error
+	// Remove stop watching the directory
+	Remove(path string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// WatcherType implementation of the watcher
+type WatcherType string
+
+const (
+	// WatcherFsnotify watch by inotify, kqueue or ReadDirectoryChangesW
+	WatcherFsnotify WatcherType = "fsnotify"
+	// WatcherPoll scan directories and compare the size and mtime of files periodically, for
+	// NFS, SMB and FUSE mounts which don't report fsnotify events
+	WatcherPoll WatcherType = "poll"
+)
+
+// ParseWatcherType parse watcher type, empty string means WatcherFsnotify
+func ParseWatcherType(watcher string) (WatcherType, error) {
+	switch w := WatcherType(watcher); w {
+	case "":
+		return WatcherFsnotify, nil
+	case WatcherFsnotify, WatcherPoll:
+		return w, nil
+	}
+	return "", fmt.Errorf("unknown watcher: %v", watcher)
+}
+
+// newWatcher returns the Watcher of options, or create the watcher of WatcherType
+func newWatcher(o *foptions) (Watcher, error) {
+	if o.Watcher != nil {
+		return o.Watcher, nil
+	}
+	if o.WatcherType == WatcherPoll {
+		return newPollWatcher(o.PollInterval), nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyWatcher{watcher: w}, nil
+}
+
+type fsnotifyWatcher struct {
+	watcher *fsnotify.Watcher
+}
+
+func (f *fsnotifyWatcher) Add(path string) error {
+	return f.watcher.Add(path)
+}
+
+func (f *fsnotifyWatcher) Remove(path string) error {
+	return f.watcher.Remove(path)
+}
+
+func (f *fsnotifyWatcher) Events() <-chan fsnotify.Event {
+	return f.watcher.Events
+}
+
+func (f *fsnotifyWatcher) Errors() <-chan error {
+	return f.watcher.Errors
+}
+
+func (f *fsnotifyWatcher) Close() error {
+	return f.watcher.Close()
+}
+
+// pollEntry snapshot of a directory entry
+type pollEntry struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// pollWatcher reports create, write and remove events by comparing snapshots of the watched
+// directories. Renames are reported as a remove and a create.
+type pollWatcher struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	dirs     map[string]map[string]pollEntry
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	w := &pollWatcher{
+		interval: interval,
+		dirs:     make(map[string]map[string]pollEntry),
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) Add(path string) error {
+	path = filepath.Clean(path)
+	entries, err := scanDir(path)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.dirs[path]; !ok {
+		w.dirs[path] = entries
+	}
+	return nil
+}
+
+func (w *pollWatcher) Remove(path string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := w.dirs[path]; !ok {
+		return fmt.Errorf("can't remove non-existent poll watch for: %v", path)
+	}
+	delete(w.dirs, path)
+	return nil
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *pollWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Close stop polling and close the channels
+func (w *pollWatcher) Close() error {
+	w.once.Do(
+		func() {
+			close(w.done)
+			w.wg.Wait()
+			close(w.events)
+			close(w.errors)
+		},
+	)
+	return nil
+}
+
+func (w *pollWatcher) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.poll()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// poll scan the watched directories and send events of the changed entries
+func (w *pollWatcher) poll() {
+	w.mutex.Lock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.mutex.Unlock()
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		entries, err := scanDir(dir)
+		if os.IsNotExist(err) {
+			// removal is reported by the parent directory
+			entries = nil
+		} else if err != nil {
+			if !w.send(nil, err) {
+				return
+			}
+			continue
+		}
+		w.mutex.Lock()
+		old, ok := w.dirs[dir]
+		if ok {
+			if entries == nil {
+				delete(w.dirs, dir)
+			} else {
+				w.dirs[dir] = entries
+			}
+		}
+		w.mutex.Unlock()
+		if !ok || entries == nil {
+			continue
+		}
+		for _, event := range diffEntries(dir, old, entries) {
+			event := event
+			if !w.send(&event, nil) {
+				return
+			}
+		}
+	}
+}
+
+// send returns false if the watcher is closed
+func (w *pollWatcher) send(event *fsnotify.Event, err error) bool {
+	if event != nil {
+		select {
+		case w.events <- *event:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+	select {
+	case w.errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func scanDir(dir string) (map[string]pollEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]pollEntry, len(infos))
+	for _, info := range infos {
+		entries[info.Name()] = pollEntry{
+			isDir:   info.IsDir(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+	}
+	return entries, nil
+}
+
+// diffEntries returns events of the changed entries ordered by name, changes of directories are
+// not reported as writes because their entries are watched by themselves.
+func diffEntries(
+	dir string, old map[string]pollEntry, entries map[string]pollEntry,
+) []fsnotify.Event {
+	names := make([]string, 0, len(old)+len(entries))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range entries {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	events := make([]fsnotify.Event, 0)
+	for _, name := range names {
+		before, existed := old[name]
+		after, exists := entries[name]
+		file := filepath.Join(dir, name)
+		switch {
+		case !exists:
+			events = append(events, fsnotify.Event{Name: file, Op: fsnotify.Remove})
+		case !existed || before.isDir != after.isDir:
+			events = append(events, fsnotify.Event{Name: file, Op: fsnotify.Create})
+		case !after.isDir && (before.size != after.size || !before.modTime.Equal(after.modTime)):
+			events = append(events, fsnotify.Event{Name: file, Op: fsnotify.Write})
+		}
+	}
+	return events
+}
@@ -0,0 +1,65 @@
+package fsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func Test_pollWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-poll")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.txt")
+
+	w := newPollWatcher(10 * time.Millisecond)
+	defer w.Close()
+	err = w.Add(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	steps := []struct {
+		name   string
+		change func() error
+		want   fsnotify.Op
+	}{
+		{
+			name: "create", want: fsnotify.Create, change: func() error {
+				return ioutil.WriteFile(file, []byte("a"), 0644)
+			},
+		},
+		{
+			name: "write", want: fsnotify.Write, change: func() error {
+				return ioutil.WriteFile(file, []byte("abc"), 0644)
+			},
+		},
+		{
+			name: "remove", want: fsnotify.Remove, change: func() error {
+				return os.Remove(file)
+			},
+		},
+	}
+	for _, step := range steps {
+		err = step.change()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case event := <-w.Events():
+			if event.Name != file || event.Op != step.want {
+				t.Errorf("%v: event = %v, want %v of %v", step.name, event, step.want, file)
+			}
+		case err := <-w.Errors():
+			t.Fatalf("%v: error: %v", step.name, err.Error())
+		case <-time.After(time.Second):
+			t.Fatalf("%v: no event", step.name)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+// Checkpoint progress of an incomplete upload, the caller keeps it and passes it back by
+// WithCheckpoint to resume the upload after a failure or a restart
+type Checkpoint struct {
+	// UploadID id of the multipart upload
+	UploadID string `json:"upload_id"`
+	// PartSize size of the parts except the last one, the upload is restarted if it's changed
+	PartSize int64 `json:"part_size"`
+	// Parts uploaded parts in order
+	Parts []CheckpointPart `json:"parts"`
+	// SHA256 sha256 of the content recorded by the upload, the upload is restarted if it's
+	// changed
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// CheckpointPart uploaded part of the checkpoint
+type CheckpointPart struct {
+	// Number part number, begin with 1
+	Number int64 `json:"number"`
+	Size   int64 `json:"size"`
+	// MD5 hex encoded md5 of the content, the part is uploaded again if the content is changed
+	MD5 string `json:"md5"`
+	// ETag etag of the part returned by the storage
+	ETag string `json:"etag"`
+}
+
+// CheckpointFunc saves the checkpoint, it's called after the upload is created and after every
+// part is uploaded, the checkpoint must not be modified
+type CheckpointFunc func(checkpoint *Checkpoint)
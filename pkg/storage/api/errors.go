@@ -0,0 +1,66 @@
+package api
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	// ErrNotExist the file doesn't exist
+	ErrNotExist = errors.New("file does not exist")
+	// ErrPermission the access is denied
+	ErrPermission = errors.New("permission denied")
+	// ErrConflict the file is changed by another request, or the precondition failed
+	ErrConflict = errors.New("conflict")
+	// ErrThrottled the request is rejected by the rate limit of the storage, retry it later
+	ErrThrottled = errors.New("request is throttled")
+	// ErrTransient the request failed by the network or the temporary failure of the storage,
+	// retry it later
+	ErrTransient = errors.New("transient error")
+)
+
+// Error error of the storage operation, it wraps the native error of the backend, and matches
+// its Kind by errors.Is. ErrNotExist and ErrPermission match the errors of os too.
+type Error struct {
+	Op   string
+	Path string
+	// Kind one of the sentinel errors of the package
+	Kind error
+	// Err native error of the backend
+	Err error
+}
+
+// Wrap wrap the native error of the operation on the path into Error of the kind, err is
+// returned as is if it's nil, kind is nil, or it's already an Error
+func Wrap(op string, path string, kind error, err error) error {
+	if err == nil || kind == nil {
+		return err
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Op: op, Path: path, Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the native error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if the target is the kind of the error
+func (e *Error) Is(target error) bool {
+	switch target {
+	case e.Kind:
+		return true
+	case os.ErrNotExist:
+		return e.Kind == ErrNotExist
+	case os.ErrPermission:
+		return e.Kind == ErrPermission
+	}
+	return false
+}
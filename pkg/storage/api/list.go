@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	// DefaultMaxKeys default max files of a page
+	DefaultMaxKeys = 1000
+)
+
+// ErrSkipAll used as a return value from WalkFunc to stop walking
+var ErrSkipAll = errors.New("skip all files")
+
+// ListOptions options of List
+type ListOptions struct {
+	// Token continuation token returned by the previous page, empty for the first page
+	Token string
+	// MaxKeys max files of a page, DefaultMaxKeys is used if it's not positive
+	MaxKeys int
+}
+
+// ListResult a page of files
+type ListResult struct {
+	// Files files of the page in lexical order of the path
+	Files []*FileInfo
+	// NextToken token of the next page, empty if it's the last page
+	NextToken string
+}
+
+// WalkFunc function called by Walk for each file
+type WalkFunc func(info *FileInfo) error
+
+// Walk walk all files which path begins with the prefix in lexical order, stop walking if fn
+// returns error, and ErrSkipAll stops walking without error.
+func Walk(ctx context.Context, storage FileStorage, prefix string, fn WalkFunc) error {
+	opts := &ListOptions{}
+	for {
+		result, err := storage.List(ctx, prefix, opts)
+		if err != nil {
+			return err
+		}
+		for _, info := range result.Files {
+			err := fn(info)
+			if err == ErrSkipAll {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if result.NextToken == "" {
+			return nil
+		}
+		opts = &ListOptions{
+			Token:   result.NextToken,
+			MaxKeys: opts.MaxKeys,
+		}
+	}
+}
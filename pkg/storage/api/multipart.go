@@ -0,0 +1,26 @@
+package api
+
+const (
+	// MinPartSize min size of the parts except the last one of S3 multipart uploads
+	MinPartSize = 5 * 1024 * 1024
+	// MaxPartSize max size of the parts of S3 multipart uploads
+	MaxPartSize int64 = 5 * 1024 * 1024 * 1024
+	// MaxParts max parts of S3 multipart uploads
+	MaxParts = 10000
+	// partSizeAlignment part sizes larger than the block size are rounded up to MiB
+	partSizeAlignment = 1024 * 1024
+)
+
+// PartSize returns the part size of uploading the content of the size in blocks, it's the block
+// size unless the content has more than MaxParts blocks, then the part size is the smallest one
+// of MiB which splits the content into MaxParts parts. Returns 0 if the block size is unknown.
+func PartSize(size int64, blockSize int64) int64 {
+	if blockSize <= 0 {
+		return 0
+	}
+	min := (size + MaxParts - 1) / MaxParts
+	if min <= blockSize {
+		return blockSize
+	}
+	return (min + partSizeAlignment - 1) / partSizeAlignment * partSizeAlignment
+}
@@ -0,0 +1,32 @@
+package api
+
+import "testing"
+
+func TestPartSize(t *testing.T) {
+	const mib = 1024 * 1024
+	tests := []struct {
+		name      string
+		size      int64
+		blockSize int64
+		want      int64
+	}{
+		{name: "small file", size: 100, blockSize: 5 * mib, want: 5 * mib},
+		{name: "max parts", size: MaxParts * 5 * mib, blockSize: 5 * mib, want: 5 * mib},
+		{name: "more parts", size: MaxParts*5*mib + 1, blockSize: 5 * mib, want: 6 * mib},
+		{name: "1 TiB", size: 1024 * 1024 * mib, blockSize: 5 * mib, want: 105 * mib},
+		{name: "unknown block size", size: 100, blockSize: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got := PartSize(tt.size, tt.blockSize)
+				if got != tt.want {
+					t.Errorf("PartSize() = %v, want %v", got, tt.want)
+				}
+				if got > 0 && (tt.size+got-1)/got > MaxParts {
+					t.Errorf("PartSize() = %v splits the content into more than MaxParts", got)
+				}
+			},
+		)
+	}
+}
@@ -2,7 +2,22 @@ package api
 
 // Options client options
 type Options struct {
+	// Mimetype Content-Type of the file
 	Mimetype string
+	// Checkpoint checkpoint of the upload to resume, nil starts a new upload
+	Checkpoint *Checkpoint
+	// SaveCheckpoint saves the progress of the upload, uploads are resumable if it's not nil
+	SaveCheckpoint CheckpointFunc
+	// SHA256 hex encoded sha256 of the whole content, which is stored with the file
+	SHA256 string
+	// ContentEncoding Content-Encoding of the file
+	ContentEncoding string
+	// CacheControl Cache-Control of the file
+	CacheControl string
+	// Metadata user metadata of the file, keys are case-insensitive
+	Metadata map[string]string
+	// Tags tags of the file
+	Tags map[string]string
 }
 
 // Option applier
@@ -30,7 +45,7 @@ func (o *Options) Apply(option ...Option) {
 	}
 }
 
-// WithMimetype settings mimetype
+// WithMimetype settings mimetype, which is the Content-Type of the file
 func WithMimetype(mimetype string) Option {
 	return OptionFunc(
 		func(o *Options) {
@@ -39,3 +54,70 @@ func WithMimetype(mimetype string) Option {
 	)
 }
 
+// WithCheckpoint resume the upload of the checkpoint, which can be nil, and save the progress
+// by save. Writers which fail keep the uploaded parts for resuming instead of aborting the
+// upload. Backends which don't support resuming ignore it.
+func WithCheckpoint(checkpoint *Checkpoint, save CheckpointFunc) Option {
+	return OptionFunc(
+		func(o *Options) {
+			o.Checkpoint = checkpoint
+			o.SaveCheckpoint = save
+		},
+	)
+}
+
+// WithSHA256 store the hex encoded sha256 of the whole content with the file, it's returned by
+// Info as FileInfo.SHA256. Backends which compute it by themselves ignore it.
+func WithSHA256(sum string) Option {
+	return OptionFunc(
+		func(o *Options) {
+			o.SHA256 = sum
+		},
+	)
+}
+
+// WithContentEncoding set the Content-Encoding of the file
+func WithContentEncoding(encoding string) Option {
+	return OptionFunc(
+		func(o *Options) {
+			o.ContentEncoding = encoding
+		},
+	)
+}
+
+// WithCacheControl set the Cache-Control of the file
+func WithCacheControl(cacheControl string) Option {
+	return OptionFunc(
+		func(o *Options) {
+			o.CacheControl = cacheControl
+		},
+	)
+}
+
+// WithMetadata add user metadata of the file, backends which don't support it ignore it
+func WithMetadata(metadata map[string]string) Option {
+	return OptionFunc(
+		func(o *Options) {
+			if o.Metadata == nil {
+				o.Metadata = make(map[string]string, len(metadata))
+			}
+			for k, v := range metadata {
+				o.Metadata[k] = v
+			}
+		},
+	)
+}
+
+// WithTags add tags of the file, backends which don't support it ignore it
+func WithTags(tags map[string]string) Option {
+	return OptionFunc(
+		func(o *Options) {
+			if o.Tags == nil {
+				o.Tags = make(map[string]string, len(tags))
+			}
+			for k, v := range tags {
+				o.Tags[k] = v
+			}
+		},
+	)
+}
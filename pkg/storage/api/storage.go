@@ -1,13 +1,15 @@
 package api
 
 import (
-"context"
-"io"
+	"context"
+	"io"
+	"time"
 )
 
 //go:generate mockgen -source ./storage.go -package mock -destination ./mock/mock.go
 
-// FileStorage file storage api
+// FileStorage file storage api, backends wrap their native errors into Error, so callers check
+// them by errors.Is with ErrNotExist, ErrPermission, ErrConflict, ErrThrottled and ErrTransient
 type FileStorage interface {
 	// Create create file and returns FileUpload object
 	Create(ctx context.Context, path string, opts ...Option) (io.WriteCloser, error)
@@ -17,11 +19,80 @@ type FileStorage interface {
 
 	// Info get file info
 	Info(ctx context.Context, path string) (*FileInfo, error)
+
+	// Delete delete file, returns nil if the file is not exists
+	Delete(ctx context.Context, path string) error
+
+	// DeleteAll delete all files under the prefix, the prefix is treated as a directory
+	DeleteAll(ctx context.Context, prefix string) error
+
+	// Copy copy file inside the storage, remote backends copy it on the server side
+	Copy(ctx context.Context, src string, dst string) error
+
+	// Move move file inside the storage, remote backends move it on the server side
+	Move(ctx context.Context, src string, dst string) error
+
+	// List list a page of files which path begins with the prefix, opts can be nil
+	List(ctx context.Context, prefix string, opts *ListOptions) (*ListResult, error)
+}
+
+// Aborter writer which can be aborted, the written content is discarded and the file isn't
+// created or changed. Writers returned by Create implement it if the backend supports it.
+type Aborter interface {
+	Abort() error
 }
 
+// UploadAborter storage which may keep incomplete uploads, such as multipart uploads of S3 or
+// temp files of the file system left by crashed processes
+type UploadAborter interface {
+	// AbortUploads abort incomplete uploads under the prefix which are started before the
+	// time and matched by match, nil matches all uploads. The path passed to match is the key
+	// of the upload, or the temp file in the directory of the file for the file system, and the
+	// upload ID is the ID of the multipart upload, or the name of the temp file. Uploads which
+	// are still written by the storage are never aborted. Returns the number of aborted uploads.
+	AbortUploads(
+		ctx context.Context, prefix string, before time.Time,
+		match func(path, uploadID string) bool,
+	) (int, error)
+}
+
+// CheckpointAborter storage which resumes uploads of checkpoints, see WithCheckpoint
+type CheckpointAborter interface {
+	// AbortCheckpoint abort the upload of the checkpoint which won't be resumed, so its parts
+	// are removed. It's a no-op if the upload is completed or aborted.
+	AbortCheckpoint(ctx context.Context, path string, checkpoint *Checkpoint) error
+}
+
+// Uploader storage which uploads ranges of files concurrently, it's faster than writing the file
+// to the writer of Create
+type Uploader interface {
+	// Upload upload size bytes of the reader to the path, ranges are read by ReadAt concurrently
+	Upload(ctx context.Context, path string, reader io.ReaderAt, size int64, opts ...Option) error
+}
+
+const (
+	// StorageClassStandard storage class of the backends which have only one class
+	StorageClassStandard = "STANDARD"
+)
+
 // FileInfo file info
 type FileInfo struct {
-	Path string
+	// Path absolute slash separated path of the file, which begins with "/"
+	Path     string
 	FileName string
-	Size int64
+	Size     int64
+	// ModTime last modified time of the file
+	ModTime time.Time
+	// ETag etag of the file, empty if the storage doesn't support it
+	ETag string
+	// SHA256 hex encoded sha256 of the content, it's only returned by Info, and empty if it
+	// isn't recorded when the file is uploaded
+	SHA256 string
+	// ContentType Content-Type of the file, it's only returned by Info
+	ContentType string
+	// Metadata user metadata of the file with lower case keys, it's only returned by Info, and
+	// nil if the storage doesn't support it
+	Metadata map[string]string
+	// StorageClass storage class of the file, empty if the storage doesn't support it
+	StorageClass string
 }
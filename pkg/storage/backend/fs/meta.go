@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// metaFilePrefix name prefix of the metadata files, the metadata of a file is kept in the
+	// sibling file named by the prefix and the file name
+	metaFilePrefix = ".fsync-meta-"
+)
+
+// fileMeta metadata of a file written by the storage, it's stale if the size or the modified
+// time of the file is changed, such as the file is replaced by others
+type fileMeta struct {
+	Size        int64             `json:"size"`
+	ModTime     time.Time         `json:"mod_time"`
+	ETag        string            `json:"etag"`
+	SHA256      string            `json:"sha256,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// metaFile returns the metadata file of the file
+func metaFile(file string) string {
+	return filepath.Join(filepath.Dir(file), metaFilePrefix+filepath.Base(file))
+}
+
+// hiddenFile returns true for the temp files and the metadata files, which aren't listed
+func hiddenFile(name string) bool {
+	return strings.HasPrefix(name, uploadFilePrefix) || strings.HasPrefix(name, metaFilePrefix)
+}
+
+// writeMeta replace the metadata of the file atomically
+func writeMeta(file string, meta *fileMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), uploadFilePrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	err2 := tmp.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), metaFile(file))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// readMeta returns the metadata of the file, nil if it's missing or stale
+func readMeta(file string, stat os.FileInfo) *fileMeta {
+	data, err := ioutil.ReadFile(metaFile(file))
+	if err != nil {
+		return nil
+	}
+	meta := &fileMeta{}
+	err = json.Unmarshal(data, meta)
+	if err != nil || meta.Size != stat.Size() || !meta.ModTime.Equal(stat.ModTime()) {
+		return nil
+	}
+	return meta
+}
+
+// removeMeta remove the metadata of the file
+func removeMeta(file string) error {
+	err := os.Remove(metaFile(file))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// md5File returns the hex encoded md5 of the file, it's the etag of files without metadata
+func md5File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lowerKeys returns the copy of the metadata with lower case keys
+func lowerKeys(metadata map[string]string) map[string]string {
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		m[strings.ToLower(k)] = v
+	}
+	return m
+}
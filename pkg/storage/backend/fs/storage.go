@@ -2,10 +2,31 @@ package fs
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"hash"
 	"io"
+	"io/ioutil"
+	"mime"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// uploadFilePrefix name prefix of the temp files of writers
+	uploadFilePrefix = ".fsync-upload-"
+)
+
+var (
+	// ErrDeleteRoot refuse to delete the whole file system
+	ErrDeleteRoot = errors.New("refuse to delete all files without root path")
 )
 
 type localFileStorage struct {
@@ -28,16 +49,104 @@ func (l *localFileStorage) Create(
 	opts ...api.Option,
 ) (io.WriteCloser, error) {
 	f := filepath.Join(l.rootPath, path)
-	err := os.MkdirAll(l.rootPath, os.ModePerm)
+	err := os.MkdirAll(filepath.Dir(f), os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, wrap("create", path, err)
 	}
 
-	fi, err := os.Create(f)
+	tmp, err := ioutil.TempFile(filepath.Dir(f), uploadFilePrefix)
 	if err != nil {
-		return nil, err
+		return nil, wrap("create", path, err)
 	}
-	return fi, nil
+	err = tmp.Chmod(0644)
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, wrap("create", path, err)
+	}
+	o := api.NewOptions()
+	o.Apply(opts...)
+	w := &fileWriter{File: tmp, path: path, file: f, options: o, md5: md5.New()}
+	if o.SHA256 == "" {
+		w.sha256 = sha256.New()
+	}
+	return w, nil
+}
+
+// fileWriter writes to a temp file which replaces the file on Close, so readers and concurrent
+// writers never see partial content. The file isn't replaced if a write failed. The metadata is
+// written before the file is replaced, it's stale if another writer replaces the file later.
+type fileWriter struct {
+	*os.File
+	path    string
+	file    string
+	err     error
+	options *api.Options
+	md5     hash.Hash
+	// sha256 nil if the sha256 is given by the options
+	sha256 hash.Hash
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	w.md5.Write(p[:n])
+	if w.sha256 != nil {
+		w.sha256.Write(p[:n])
+	}
+	if err != nil {
+		w.err = wrap("write", w.path, err)
+		return n, w.err
+	}
+	return n, nil
+}
+
+func (w *fileWriter) Close() error {
+	err := w.err
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = w.File.Stat()
+	}
+	err2 := w.File.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = writeMeta(w.file, w.meta(stat))
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.file)
+	}
+	if err != nil {
+		_ = os.Remove(w.Name())
+		return wrap("close", w.path, err)
+	}
+	return nil
+}
+
+// meta returns the metadata of the written temp file
+func (w *fileWriter) meta(stat os.FileInfo) *fileMeta {
+	meta := &fileMeta{
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+		ETag:        hex.EncodeToString(w.md5.Sum(nil)),
+		SHA256:      w.options.SHA256,
+		ContentType: w.options.Mimetype,
+		Metadata:    lowerKeys(w.options.Metadata),
+	}
+	if w.sha256 != nil {
+		meta.SHA256 = hex.EncodeToString(w.sha256.Sum(nil))
+	}
+	return meta
+}
+
+// Abort remove the temp file without replacing the file
+func (w *fileWriter) Abort() error {
+	_ = w.File.Close()
+	err := os.Remove(w.Name())
+	if err != nil && !os.IsNotExist(err) {
+		return wrap("abort", w.path, err)
+	}
+	return nil
 }
 
 func (l *localFileStorage) Get(
@@ -46,25 +155,305 @@ func (l *localFileStorage) Get(
 	f := filepath.Join(l.rootPath, path)
 	fi, err := os.Open(f)
 	if err != nil {
-		return nil, err
+		return nil, wrap("get", path, err)
 	}
 	return fi, nil
 }
 
 func (l *localFileStorage) Info(ctx context.Context, path string) (*api.FileInfo, error) {
-	file, err := os.Open(path)
+	file := filepath.Join(l.rootPath, path)
+	stat, err := os.Stat(file)
 	if err != nil {
-		return nil, err
-	}
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, err
+		return nil, wrap("info", path, err)
 	}
 	fileInfo := &api.FileInfo{
 		Path:     path,
 		FileName: stat.Name(),
 		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		// the content type is guessed by the extension if it isn't recorded
+		ContentType:  mime.TypeByExtension(filepath.Ext(stat.Name())),
+		Metadata:     make(map[string]string),
+		StorageClass: api.StorageClassStandard,
 	}
-
+	if stat.IsDir() {
+		return fileInfo, nil
+	}
+	meta := readMeta(file, stat)
+	if meta == nil {
+		// the file isn't written by the storage or it's changed by others, the etag is computed
+		fileInfo.ETag, err = md5File(file)
+		if err != nil {
+			return nil, wrap("info", path, err)
+		}
+		return fileInfo, nil
+	}
+	fileInfo.ETag = meta.ETag
+	fileInfo.SHA256 = meta.SHA256
+	if meta.ContentType != "" {
+		fileInfo.ContentType = meta.ContentType
+	}
+	fileInfo.Metadata = lowerKeys(meta.Metadata)
 	return fileInfo, nil
 }
+
+func (l *localFileStorage) Delete(ctx context.Context, path string) error {
+	f := filepath.Join(l.rootPath, path)
+	err := os.Remove(f)
+	if err != nil && !os.IsNotExist(err) {
+		return wrap("delete", path, err)
+	}
+	return wrap("delete", path, removeMeta(f))
+}
+
+func (l *localFileStorage) DeleteAll(ctx context.Context, prefix string) error {
+	if strings.Trim(filepath.ToSlash(prefix), "/") == "" {
+		// never remove the root itself
+		if l.rootPath == "" {
+			return ErrDeleteRoot
+		}
+		return wrap("delete", prefix, l.removeChildren(l.rootPath))
+	}
+	f := filepath.Join(l.rootPath, prefix)
+	return wrap("delete", prefix, os.RemoveAll(f))
+}
+
+func (l *localFileStorage) removeChildren(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	err2 := d.Close()
+	if err != nil {
+		return err
+	}
+	if err2 != nil {
+		return err2
+	}
+	for _, name := range names {
+		err := os.RemoveAll(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy copy the file with the recorded metadata
+func (l *localFileStorage) Copy(ctx context.Context, src string, dst string) error {
+	file := filepath.Join(l.rootPath, src)
+	reader, err := os.Open(file)
+	if err != nil {
+		return wrap("copy", src, err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	stat, err := reader.Stat()
+	if err != nil {
+		return wrap("copy", src, err)
+	}
+	opts := make([]api.Option, 0)
+	if meta := readMeta(file, stat); meta != nil {
+		opts = append(
+			opts, api.WithMimetype(meta.ContentType), api.WithSHA256(meta.SHA256),
+			api.WithMetadata(meta.Metadata),
+		)
+	}
+	writer, err := l.Create(ctx, dst, opts...)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		_ = writer.(*fileWriter).Abort()
+		return wrap("copy", src, err)
+	}
+	return writer.Close()
+}
+
+// Move move the file with the metadata, renaming keeps the modified time so the metadata isn't
+// stale
+func (l *localFileStorage) Move(ctx context.Context, src string, dst string) error {
+	from := filepath.Join(l.rootPath, src)
+	to := filepath.Join(l.rootPath, dst)
+	err := os.MkdirAll(filepath.Dir(to), os.ModePerm)
+	if err != nil {
+		return wrap("move", dst, err)
+	}
+	err = os.Rename(from, to)
+	if err != nil {
+		return wrap("move", src, err)
+	}
+	err = os.Rename(metaFile(from), metaFile(to))
+	if os.IsNotExist(err) {
+		err = removeMeta(to)
+	}
+	return wrap("move", src, err)
+}
+
+// AbortUploads remove the temp files of writers under the prefix which are modified before the
+// time, they are left by crashed processes. Temp files of writers in progress are modified by
+// every write.
+func (l *localFileStorage) AbortUploads(
+	ctx context.Context, prefix string, before time.Time,
+	match func(path, uploadID string) bool,
+) (int, error) {
+	prefix = "/" + strings.TrimLeft(filepath.ToSlash(prefix), "/")
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	root := filepath.Join(l.rootPath, filepath.FromSlash(dir))
+	aborted := 0
+	err := filepath.Walk(
+		root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || !strings.HasPrefix(info.Name(), uploadFilePrefix) ||
+				!info.ModTime().Before(before) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			path := dir + filepath.ToSlash(rel)
+			if !strings.HasPrefix(path, prefix) || match != nil && !match(path, info.Name()) {
+				return nil
+			}
+			err = os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			aborted++
+			return nil
+		},
+	)
+	return aborted, wrap("abort", prefix, err)
+}
+
+func (l *localFileStorage) List(
+	ctx context.Context, prefix string, opts *api.ListOptions,
+) (*api.ListResult, error) {
+	if opts == nil {
+		opts = &api.ListOptions{}
+	}
+	maxKeys := opts.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = api.DefaultMaxKeys
+	}
+	prefix = "/" + strings.TrimLeft(filepath.ToSlash(prefix), "/")
+	// walk the deepest directory which contains all matched files
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	w := &lister{prefix: prefix, token: opts.Token, maxKeys: maxKeys}
+	err := w.walk(filepath.Join(l.rootPath, filepath.FromSlash(dir)), dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, wrap("list", prefix, err)
+	}
+	result := &api.ListResult{
+		Files: w.files,
+	}
+	if len(w.files) > maxKeys {
+		result.Files = w.files[:maxKeys]
+		result.NextToken = w.files[maxKeys-1].Path
+	}
+	return result, nil
+}
+
+// lister walks the directories in lexical order of the paths, directories before the token are
+// skipped and walking stops after a file more than the page, so a page doesn't read the whole
+// tree.
+type lister struct {
+	prefix  string
+	token   string
+	maxKeys int
+	files   []*api.FileInfo
+}
+
+// walk append the files of the directory until the page is full, dir is the slash separated
+// path of the directory which ends with "/"
+func (w *lister) walk(root string, dir string) error {
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	// directories are sorted by the path with "/", e.g. "a.txt" < "a/" < "a0"
+	key := func(info os.FileInfo) string {
+		if info.IsDir() {
+			return info.Name() + "/"
+		}
+		return info.Name()
+	}
+	sort.Slice(
+		infos, func(i, j int) bool {
+			return key(infos[i]) < key(infos[j])
+		},
+	)
+	for _, info := range infos {
+		if len(w.files) > w.maxKeys {
+			return nil
+		}
+		path := dir + key(info)
+		if info.IsDir() {
+			if !strings.HasPrefix(path, w.prefix) && !strings.HasPrefix(w.prefix, path) {
+				continue
+			}
+			// all files of the directory are before the token
+			if path <= w.token && !strings.HasPrefix(w.token, path) {
+				continue
+			}
+			err = w.walk(filepath.Join(root, info.Name()), path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(path, w.prefix) || path <= w.token || hiddenFile(info.Name()) {
+			continue
+		}
+		fileInfo := &api.FileInfo{
+			Path:         path,
+			FileName:     info.Name(),
+			Size:         info.Size(),
+			ModTime:      info.ModTime(),
+			StorageClass: api.StorageClassStandard,
+		}
+		file := filepath.Join(root, info.Name())
+		if meta := readMeta(file, info); meta != nil {
+			fileInfo.ETag = meta.ETag
+			fileInfo.SHA256 = meta.SHA256
+		} else if fileInfo.ETag, err = md5File(file); err != nil {
+			if os.IsNotExist(err) {
+				// the file is removed after the directory is read
+				continue
+			}
+			return err
+		}
+		w.files = append(w.files, fileInfo)
+	}
+	return nil
+}
+
+// wrap wrap the error of the file system into api.Error
+func wrap(op string, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return api.Wrap(op, path, api.ErrNotExist, err)
+	case errors.Is(err, os.ErrPermission):
+		return api.Wrap(op, path, api.ErrPermission, err)
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EBUSY),
+		errors.Is(err, syscall.EINTR), errors.As(err, &timeout) && timeout.Timeout():
+		return api.Wrap(op, path, api.ErrTransient, err)
+	}
+	return err
+}
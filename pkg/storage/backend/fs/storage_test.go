@@ -0,0 +1,172 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/storagetest"
+)
+
+func TestLocalFileStorage_conformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-fs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewLocalFileStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storagetest.Run(t, storagetest.Config{Storage: s, Metadata: true})
+}
+
+func TestLocalFileStorage_AbortUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-fs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewLocalFileStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx := context.Background()
+	// writers of crashed processes are never closed
+	for _, path := range []string{"/a/old", "/a/new", "/a/c/old", "/b/old"} {
+		w, err := s.Create(ctx, path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.HasSuffix(path, "old") {
+			old := time.Now().Add(-time.Hour)
+			err = os.Chtimes(w.(*fileWriter).Name(), old, old)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	// uploads of other directories under the prefix are kept
+	aborted, err := s.(api.UploadAborter).AbortUploads(
+		ctx, "/a/", time.Now().Add(-time.Minute), func(path, uploadID string) bool {
+			if !strings.HasPrefix(uploadID, uploadFilePrefix) {
+				t.Errorf("AbortUploads() upload ID = %v, want the temp file", uploadID)
+			}
+			return !strings.HasPrefix(path, "/a/c/")
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if aborted != 1 {
+		t.Errorf("AbortUploads() = %v, want 1", aborted)
+	}
+	for _, sub := range []string{"a/c", "b"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(files) != 1 {
+			t.Errorf("temp files of %v = %v, want 1", sub, len(files))
+		}
+	}
+}
+
+func TestLocalFileStorage_Info(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsync-fs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewLocalFileStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx := context.Background()
+	w, err := s.Create(
+		ctx, "/a", api.WithMimetype("text/plain"),
+		api.WithMetadata(map[string]string{"Owner": "fsync"}),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = w.Write([]byte("hello"))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		etag        string
+		sha256      string
+		contentType string
+		owner       string
+	}{
+		{
+			name:        "written",
+			etag:        "5d41402abc4b2a76b9719d911017c592",
+			sha256:      "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			contentType: "text/plain",
+			owner:       "fsync",
+		},
+		{
+			// the metadata is stale after the file is changed by others
+			name:        "changed",
+			content:     "world!",
+			etag:        "08cf82251c975a5e9734699fadf5e9c0",
+			contentType: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if tt.content != "" {
+					err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte(tt.content), 0644)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				info, err := s.Info(ctx, "/a")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if info.ETag != tt.etag || info.SHA256 != tt.sha256 ||
+					info.ContentType != tt.contentType || info.Metadata["owner"] != tt.owner ||
+					info.StorageClass != api.StorageClassStandard {
+					t.Errorf("Info() = %+v", info)
+				}
+			},
+		)
+	}
+	// the metadata file is hidden and moved with the file
+	err = s.Move(ctx, "/a", "/b")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(names) != 2 || names[1].Name() != "b" {
+		t.Errorf("files = %v, want the metadata file and b", len(names))
+	}
+	result, err := s.List(ctx, "/", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the etag of the changed file is computed as Info does
+	if len(result.Files) != 1 || result.Files[0].Path != "/b" ||
+		result.Files[0].ETag != tests[1].etag {
+		t.Errorf("List() = %+v, want /b", result.Files)
+	}
+}
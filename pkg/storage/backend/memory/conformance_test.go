@@ -0,0 +1,11 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/pjoc-team/fsync/pkg/storage/storagetest"
+)
+
+func TestStorage_conformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Config{Storage: NewMemoryFileStorage(), Metadata: true})
+}
@@ -0,0 +1,372 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+)
+
+var (
+	// ErrInjected default error of the injected faults, it's a transient error
+	ErrInjected = fmt.Errorf("injected fault: %w", api.ErrTransient)
+	// ErrClosed write to a closed writer
+	ErrClosed = errors.New("writer is closed")
+	// ErrAborted write to an aborted writer
+	ErrAborted = errors.New("writer is aborted")
+)
+
+// Faults faults injected into the operations of the storage
+type Faults struct {
+	// Latency delay of every operation
+	Latency time.Duration
+	// ErrorRate probability of failing an operation, from 0 to 1
+	ErrorRate float64
+	// FailAfterBytes fail writers and readers after the bytes are transferred, 0 means never
+	FailAfterBytes int64
+	// Err error of the injected faults, ErrInjected is used if it's nil
+	Err error
+}
+
+var _ api.FileStorage = (*Storage)(nil)
+
+type object struct {
+	data     []byte
+	modTime  time.Time
+	etag     string
+	mimetype string
+	sha256   string
+	metadata map[string]string
+}
+
+// Storage thread-safe file storage in memory, for tests and dry runs
+type Storage struct {
+	mutex  sync.RWMutex
+	files  map[string]*object
+	faults Faults
+	rand   *rand.Rand
+}
+
+// NewMemoryFileStorage create memory file storage without faults
+func NewMemoryFileStorage() *Storage {
+	return &Storage{
+		files: make(map[string]*object),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetFaults replace the injected faults, the zero value disables them
+func (s *Storage) SetFaults(faults Faults) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = faults
+}
+
+// fault wait the latency, returns the injected error by the error rate, or the error of ctx
+func (s *Storage) fault(ctx context.Context) (Faults, error) {
+	s.mutex.Lock()
+	faults := s.faults
+	failed := faults.ErrorRate > 0 && s.rand.Float64() < faults.ErrorRate
+	s.mutex.Unlock()
+	if faults.Err == nil {
+		faults.Err = ErrInjected
+	}
+	if faults.Latency > 0 {
+		timer := time.NewTimer(faults.Latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return faults, ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return faults, err
+	}
+	if failed {
+		return faults, faults.Err
+	}
+	return faults, nil
+}
+
+// cleanPath returns the absolute slash separated path
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func notExist(op string, p string) error {
+	return api.Wrap(op, p, api.ErrNotExist, os.ErrNotExist)
+}
+
+func (s *Storage) Create(
+	ctx context.Context, path string, opts ...api.Option,
+) (io.WriteCloser, error) {
+	faults, err := s.fault(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o := api.NewOptions()
+	o.Apply(opts...)
+	return &writer{
+		ctx:      ctx,
+		storage:  s,
+		path:     cleanPath(path),
+		mimetype: o.Mimetype,
+		sha256:   o.SHA256,
+		metadata: o.Metadata,
+		faults:   faults,
+	}, nil
+}
+
+// writer buffers the content, the file is visible after Close like object storages, and it's
+// not created if a write failed
+type writer struct {
+	ctx      context.Context
+	storage  *Storage
+	path     string
+	mimetype string
+	sha256   string
+	metadata map[string]string
+	faults   Faults
+	buf      bytes.Buffer
+	closed   bool
+	err      error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if limit := w.faults.FailAfterBytes; limit > 0 && int64(w.buf.Len()+len(p)) > limit {
+		n, _ := w.buf.Write(p[:limit-int64(w.buf.Len())])
+		w.err = w.faults.Err
+		return n, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	if w.closed && w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	_, err := w.storage.fault(w.ctx)
+	if err != nil {
+		return err
+	}
+	data := w.buf.Bytes()
+	sum := md5.Sum(data)
+	if w.sha256 == "" {
+		h := sha256.Sum256(data)
+		w.sha256 = hex.EncodeToString(h[:])
+	}
+	w.storage.mutex.Lock()
+	defer w.storage.mutex.Unlock()
+	w.storage.files[w.path] = &object{
+		data:     data,
+		modTime:  time.Now(),
+		etag:     hex.EncodeToString(sum[:]),
+		mimetype: w.mimetype,
+		sha256:   w.sha256,
+		metadata: lowerKeys(w.metadata),
+	}
+	return nil
+}
+
+// Abort discard the written content
+func (w *writer) Abort() error {
+	if !w.closed {
+		w.closed = true
+		w.err = ErrAborted
+	}
+	return nil
+}
+
+func (s *Storage) Get(
+	ctx context.Context, path string, options ...api.Option,
+) (io.ReadCloser, error) {
+	faults, err := s.fault(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path = cleanPath(path)
+	s.mutex.RLock()
+	f, ok := s.files[path]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, notExist("open", path)
+	}
+	var reader io.Reader = bytes.NewReader(f.data)
+	if faults.FailAfterBytes > 0 && int64(len(f.data)) > faults.FailAfterBytes {
+		reader = io.MultiReader(
+			io.LimitReader(reader, faults.FailAfterBytes), &errReader{err: faults.Err},
+		)
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+func (s *Storage) Info(ctx context.Context, path string) (*api.FileInfo, error) {
+	_, err := s.fault(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path = cleanPath(path)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	f, ok := s.files[path]
+	if !ok {
+		return nil, notExist("stat", path)
+	}
+	info := f.info(path)
+	info.SHA256 = f.sha256
+	info.ContentType = f.mimetype
+	info.Metadata = lowerKeys(f.metadata)
+	return info, nil
+}
+
+// lowerKeys returns the copy of the metadata with lower case keys
+func lowerKeys(metadata map[string]string) map[string]string {
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		m[strings.ToLower(k)] = v
+	}
+	return m
+}
+
+func (f *object) info(p string) *api.FileInfo {
+	return &api.FileInfo{
+		Path:     p,
+		FileName: path.Base(p),
+		Size:     int64(len(f.data)),
+		ModTime:  f.modTime,
+		ETag:     f.etag,
+		// all files are in the same class
+		StorageClass: api.StorageClassStandard,
+	}
+}
+
+func (s *Storage) Delete(ctx context.Context, path string) error {
+	_, err := s.fault(ctx)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.files, cleanPath(path))
+	return nil
+}
+
+func (s *Storage) DeleteAll(ctx context.Context, prefix string) error {
+	_, err := s.fault(ctx)
+	if err != nil {
+		return err
+	}
+	dir := strings.TrimSuffix(cleanPath(prefix), "/")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for p := range s.files {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			delete(s.files, p)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) Copy(ctx context.Context, src string, dst string) error {
+	return s.copy(ctx, src, dst, false)
+}
+
+func (s *Storage) Move(ctx context.Context, src string, dst string) error {
+	return s.copy(ctx, src, dst, true)
+}
+
+func (s *Storage) copy(ctx context.Context, src string, dst string, move bool) error {
+	_, err := s.fault(ctx)
+	if err != nil {
+		return err
+	}
+	src, dst = cleanPath(src), cleanPath(dst)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[src]
+	if !ok {
+		return notExist("copy", src)
+	}
+	copied := *f
+	copied.modTime = time.Now()
+	s.files[dst] = &copied
+	if move && src != dst {
+		delete(s.files, src)
+	}
+	return nil
+}
+
+func (s *Storage) List(
+	ctx context.Context, prefix string, opts *api.ListOptions,
+) (*api.ListResult, error) {
+	_, err := s.fault(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &api.ListOptions{}
+	}
+	maxKeys := opts.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = api.DefaultMaxKeys
+	}
+	prefix = "/" + strings.TrimLeft(prefix, "/")
+
+	s.mutex.RLock()
+	files := make([]*api.FileInfo, 0)
+	for p, f := range s.files {
+		if strings.HasPrefix(p, prefix) && p > opts.Token {
+			files = append(files, f.info(p))
+		}
+	}
+	s.mutex.RUnlock()
+	sort.Slice(
+		files, func(i, j int) bool {
+			return files[i].Path < files[j].Path
+		},
+	)
+	result := &api.ListResult{
+		Files: files,
+	}
+	if len(files) > maxKeys {
+		result.Files = files[:maxKeys]
+		result.NextToken = files[maxKeys-1].Path
+	}
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+)
+
+func write(t *testing.T, s api.FileStorage, path string, data string) error {
+	t.Helper()
+	w, err := s.Create(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, data)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryFileStorage()
+	for _, path := range []string{"/a/1.txt", "a/2.txt", "/b/3.txt"} {
+		err := write(t, s, path, path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	info, err := s.Info(ctx, "/a/2.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info.Path != "/a/2.txt" || info.Size != 7 || info.ETag == "" {
+		t.Errorf("Info() = %+v", info)
+	}
+	_, err = s.Get(ctx, "/c.txt")
+	if !errors.Is(err, api.ErrNotExist) {
+		t.Errorf("Get() of missing file, error = %v", err)
+	}
+
+	err = s.Move(ctx, "/a/1.txt", "/b/1.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	result, err := s.List(ctx, "/b/", &api.ListOptions{MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Files) != 1 || result.Files[0].Path != "/b/1.txt" || result.NextToken == "" {
+		t.Fatalf("List() = %+v", result)
+	}
+	result, err = s.List(ctx, "/b/", &api.ListOptions{MaxKeys: 1, Token: result.NextToken})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Files) != 1 || result.Files[0].Path != "/b/3.txt" || result.NextToken != "" {
+		t.Fatalf("List() of next page = %+v", result)
+	}
+
+	err = s.DeleteAll(ctx, "/b")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	result, err = s.List(ctx, "/", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Files) != 1 || result.Files[0].Path != "/a/2.txt" {
+		t.Errorf("List() after DeleteAll() = %+v", result)
+	}
+}
+
+func TestStorage_SetFaults(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryFileStorage()
+	err := write(t, s, "/a.txt", "abcdef")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	errFault := errors.New("fault")
+	s.SetFaults(Faults{FailAfterBytes: 3, Err: errFault})
+	err = write(t, s, "/b.txt", "abcdef")
+	if err != errFault {
+		t.Errorf("write after 3 bytes, error = %v, want %v", err, errFault)
+	}
+	r, err := s.Get(ctx, "/a.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != errFault || string(data) != "abc" {
+		t.Errorf("read after 3 bytes = %q, error = %v", data, err)
+	}
+
+	s.SetFaults(Faults{ErrorRate: 1})
+	_, err = s.Info(ctx, "/a.txt")
+	if !errors.Is(err, api.ErrTransient) {
+		t.Errorf("Info() with error rate 1, error = %v", err)
+	}
+
+	s.SetFaults(Faults{Latency: time.Minute})
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = s.Delete(ctx, "/a.txt")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Delete() with latency, error = %v", err)
+	}
+
+	s.SetFaults(Faults{})
+	_, err = s.Info(context.Background(), "/b.txt")
+	if !errors.Is(err, api.ErrNotExist) {
+		t.Errorf("file of the failed write exists, error = %v", err)
+	}
+}
@@ -3,16 +3,59 @@ package oss
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	api2 "github.com/pjoc-team/fsync/pkg/storage/api"
 	"github.com/pjoc-team/fsync/pkg/util/fs"
 	"github.com/pjoc-team/tracing/logger"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// maxDeleteObjects max objects of a DeleteObjects request
+	maxDeleteObjects = 1000
+	// maxCopyObjectSize max object size of a CopyObject request, larger objects are copied
+	// by UploadPartCopy
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	// copyPartSize part size of UploadPartCopy
+	copyPartSize = 512 * 1024 * 1024
+	// abortTimeout timeout of aborting a multipart upload
+	abortTimeout = 30 * time.Second
+	// defaultConcurrency default number of in-flight parts of an upload
+	defaultConcurrency = 4
+	// defaultMemoryLimit default memory of the buffers of in-flight parts of all uploads
+	defaultMemoryLimit = 64 * 1024 * 1024
+	// partGrowth parts of the same size of content of unknown size, the part size doubles after
+	// them, so content of about 5 TiB fits in api.MaxParts parts of the min block size
+	partGrowth = 1000
+	// sha256Metadata metadata key of the hex encoded sha256 of the object
+	sha256Metadata = "sha256"
+)
+
+var (
+	// errAborted the upload is aborted by Abort
+	errAborted = errors.New("upload is aborted")
+	// errClosed write to the completed upload
+	errClosed = errors.New("upload is completed")
 )
 
 type storage struct {
@@ -20,13 +63,32 @@ type storage struct {
 	bucket         string
 	newSessionFunc func() (*session.Session, error)
 	sess           *session.Session
+	// concurrency in-flight parts of an upload
+	concurrency int
+	// memory limits the buffers of in-flight parts of all uploads
+	memory      *semaphore.Weighted
+	memoryLimit int64
+	// client client of the session, tests replace it by a stub
+	client s3iface.S3API
+	// active multipart uploads in progress, they're never aborted by AbortUploads
+	active      map[string]int
+	activeMutex sync.Mutex
+	// skipETagCheck etags of uploads aren't compared with the md5 of the content
+	skipETagCheck bool
 }
 
-// NewOssStorage create s3 storage
+// NewOssStorage create s3 storage, blockSize is the part size of multipart uploads, which is
+// between api.MinPartSize and api.MaxPartSize
 func NewOssStorage(
 	conf *Conf,
 	blockSize int, debug bool,
 ) (api2.FileStorage, error) {
+	if blockSize < api2.MinPartSize || int64(blockSize) > api2.MaxPartSize {
+		return nil, fmt.Errorf(
+			"block size: %v must be between %v and %v", blockSize, api2.MinPartSize,
+			api2.MaxPartSize,
+		)
+	}
 	s := &storage{}
 	s.newSessionFunc = func() (*session.Session, error) {
 		creds := credentials.NewStaticCredentials(conf.SecretID, conf.SecretKey, "")
@@ -54,37 +116,190 @@ func NewOssStorage(
 		return nil, err
 	}
 	s.sess = sess
+	s.client = s3.New(sess)
 
 	s.blockSize = blockSize
 	s.bucket = conf.Bucket
+	s.concurrency = conf.Concurrency
+	if s.concurrency <= 0 {
+		s.concurrency = defaultConcurrency
+	}
+	s.memoryLimit = conf.MemoryLimit
+	if s.memoryLimit <= 0 {
+		s.memoryLimit = defaultMemoryLimit
+	}
+	// the budget holds a part of the block size at least
+	if s.memoryLimit < int64(blockSize) {
+		s.memoryLimit = int64(blockSize)
+	}
+	s.memory = semaphore.NewWeighted(s.memoryLimit)
+	s.skipETagCheck = conf.SkipETagCheck
 	return s, nil
 }
 
 func (s *storage) Create(ctx context.Context, path string, opts ...api2.Option) (
 	io.WriteCloser, error,
 ) {
-	log := logger.ContextLog(ctx)
+	return s.create(ctx, path, 0, opts...)
+}
+
+// Upload upload the file of the size, parts are read by ReadAt and uploaded concurrently, the
+// part size is chosen by the size, see api.PartSize
+func (s *storage) Upload(
+	ctx context.Context, path string, reader io.ReaderAt, size int64, opts ...api2.Option,
+) error {
+	writer, err := s.create(ctx, path, api2.PartSize(size, int64(s.blockSize)), opts...)
+	if err != nil {
+		return err
+	}
+	err = writer.readFrom(reader, size)
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// create create the writer, or resume the upload of the checkpoint. The multipart upload is
+// created when the content exceeds one part, smaller files are put by a single request. Parts
+// of content of unknown size grow from the block size if partSize is 0.
+func (s *storage) create(
+	ctx context.Context, path string, partSize int64, opts ...api2.Option,
+) (*ossWriter, error) {
+	growing := partSize <= 0
+	if growing {
+		partSize = int64(s.blockSize)
+	}
 	// sess, err := s.newSessionFunc()
 	// if err != nil {
 	// 	log.ErrorContextf(ctx, "failed to init upload, err: %v", err.Error())
 	// 	return nil, err
 	// }
-	service := s3.New(s.sess)
-	upload, err := service.CreateMultipartUpload(
-		&s3.CreateMultipartUploadInput{
-			Bucket: aws.String(s.bucket),
-			Key:    aws.String(path),
+	o := api2.NewOptions()
+	o.Apply(opts...)
+	service := s.client
+	if o.SaveCheckpoint != nil && o.Checkpoint != nil {
+		writer, err := s.resume(ctx, service, path, partSize, o)
+		if err != nil {
+			return nil, err
+		}
+		if writer != nil {
+			writer.growing = growing
+			return writer, nil
+		}
+	}
+	writer := s.ossWriteCloser(ctx, service, nil, path, partSize)
+	writer.save = o.SaveCheckpoint
+	writer.growing = growing
+	writer.sha256 = o.SHA256
+	writer.options = o
+	return writer, nil
+}
+
+// resume returns the writer which continues the upload of the checkpoint, parts which are
+// listed by the storage with the same etag and size are reused if their content is unchanged.
+// It returns nil if the upload can't be resumed.
+func (s *storage) resume(
+	ctx context.Context, service s3iface.S3API, path string, partSize int64, o *api2.Options,
+) (*ossWriter, error) {
+	log := logger.ContextLog(ctx)
+	checkpoint := o.Checkpoint
+	if checkpoint.UploadID == "" {
+		return nil, nil
+	}
+	if checkpoint.PartSize != partSize {
+		log.Infof(
+			"part size of upload: %v is changed from: %v, restart it", checkpoint.UploadID,
+			checkpoint.PartSize,
+		)
+		s.abortStale(ctx, path, checkpoint)
+		return nil, nil
+	}
+	if checkpoint.SHA256 != o.SHA256 {
+		log.Infof("content of upload: %v is changed, restart it", checkpoint.UploadID)
+		s.abortStale(ctx, path, checkpoint)
+		return nil, nil
+	}
+	listed := make(map[int64]*s3.Part)
+	err := service.ListPartsPagesWithContext(
+		ctx, &s3.ListPartsInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(path),
+			UploadId: aws.String(checkpoint.UploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				listed[aws.Int64Value(part.PartNumber)] = part
+			}
+			return true
 		},
 	)
-	// upload, _, err := s.client.Object.InitiateMultipartUpload(ctx, path, nil)
+	if errorKind(err) == api2.ErrNotExist {
+		log.Infof("upload: %v is completed or aborted, restart it", checkpoint.UploadID)
+		return nil, nil
+	}
 	if err != nil {
-		log.Errorf("failed to init upload, err: %v", err.Error())
-		return nil, err
+		log.Errorf(
+			"failed to list parts of upload: %v, error: %v", checkpoint.UploadID, err.Error(),
+		)
+		return nil, wrap("create", path, err)
+	}
+	resumed := make(map[int64]api2.CheckpointPart)
+	for _, part := range checkpoint.Parts {
+		p, ok := listed[part.Number]
+		if ok && aws.Int64Value(p.Size) == part.Size &&
+			strings.Trim(aws.StringValue(p.ETag), "\"") == part.ETag {
+			resumed[part.Number] = part
+		}
+	}
+	log.Infof(
+		"resume upload: %v of object: %v, uploaded parts: %v", checkpoint.UploadID, path,
+		len(resumed),
+	)
+	upload := &s3.CreateMultipartUploadOutput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(path),
+		UploadId: aws.String(checkpoint.UploadID),
 	}
-	writer := s.ossWriteCloser(ctx, service, upload, path)
+	writer := s.ossWriteCloser(ctx, service, upload, path, partSize)
+	s.track(checkpoint.UploadID, writer.done)
+	writer.save = o.SaveCheckpoint
+	writer.resumed = resumed
+	writer.sha256 = o.SHA256
+	writer.options = o
 	return writer, nil
 }
 
+// abortStale abort the upload of the checkpoint which is restarted, its parts are never
+// completed
+func (s *storage) abortStale(ctx context.Context, path string, checkpoint *api2.Checkpoint) {
+	err := s.AbortCheckpoint(ctx, path, checkpoint)
+	if err != nil {
+		logger.ContextLog(ctx).Errorf(
+			"failed to abort stale upload: %v, error: %v", checkpoint.UploadID, err.Error(),
+		)
+	}
+}
+
+// AbortCheckpoint abort the multipart upload of the checkpoint, it's a no-op if the upload is
+// completed or aborted
+func (s *storage) AbortCheckpoint(
+	ctx context.Context, path string, checkpoint *api2.Checkpoint,
+) error {
+	if checkpoint == nil || checkpoint.UploadID == "" {
+		return nil
+	}
+	_, err := s.client.AbortMultipartUploadWithContext(
+		ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(path),
+			UploadId: aws.String(checkpoint.UploadID),
+		},
+	)
+	if err != nil && errorKind(err) != api2.ErrNotExist {
+		return wrap("abort", path, err)
+	}
+	return nil
+}
+
 func (s *storage) Get(
 	ctx context.Context, path string,
 	options ...api2.Option,
@@ -94,76 +309,403 @@ func (s *storage) Get(
 	// 	log.ErrorContextf(ctx, "failed to init upload, err: %v", err.Error())
 	// 	return nil, err
 	// }
-	service := s3.New(s.sess)
-	resp, err := service.GetObject(
-		&s3.GetObjectInput{
+	service := s.client
+	resp, err := service.GetObjectWithContext(
+		ctx, &s3.GetObjectInput{
 			Bucket: aws.String(s.bucket),
 			Key:    aws.String(path),
 		},
 	)
 	if err != nil {
-		return nil, err
+		return nil, wrap("get", path, err)
 	}
 	return resp.Body, err
 }
 
 func (s *storage) ossWriteCloser(
-	ctx context.Context, service *s3.S3, upload *s3.CreateMultipartUploadOutput, name string,
-) io.WriteCloser {
+	ctx context.Context, service s3iface.S3API, upload *s3.CreateMultipartUploadOutput, name string,
+	partSize int64,
+) *ossWriter {
 	o := &ossWriter{
 		ctx:        ctx,
+		partSize:   partSize,
 		upload:     upload,
 		s:          s,
 		service:    service,
 		name:       name,
 		partNumber: 1,
 		complete:   &s3.CompletedMultipartUpload{},
-		buf:        &bytes.Buffer{},
+		done:       make(chan struct{}),
+		slots:      make(chan struct{}, s.concurrency),
+		options:    api2.NewOptions(),
 	}
+	go o.abortOnCancel()
 	return o
 }
 
+// ossWriter writer of the object, content of one block is put by a single request on Close, and
+// the multipart upload is created when the content exceeds one block. The upload is aborted on
+// write errors, close errors, Abort and the cancellation of the context, so no parts are left in
+// the bucket. Resumable writers keep the parts on errors and cancellation, and are only aborted
+// by Abort.
+//
+// Parts are uploaded in background, at most concurrency parts of a writer are in flight. The
+// buffers of all writers, including the part being written, are limited by the memory budget
+// of the storage. Parts of Upload larger than the budget aren't buffered, they are read twice
+// from the reader, for the md5 and for the request. Headers, metadata and tags of the options
+// are applied when the object or the multipart upload is created.
+//
+// Every request carries the Content-MD5 of its body, so the storage rejects corrupted content,
+// and plain md5 etags of the responses are checked again. The sha256 of the whole content is
+// stored in the object metadata, it's computed for content put by a single request, and must be
+// given by api.WithSHA256 for multipart uploads.
 type ossWriter struct {
 	ctx     context.Context
 	s       *storage
-	service *s3.S3
+	service s3iface.S3API
 	// upload     *cos.InitiateMultipartUploadResult
+	// upload the multipart upload, nil until the content exceeds one block
 	upload     *s3.CreateMultipartUploadOutput
 	name       string
 	partNumber int64 // begin with 1
 	// optcom     *cos.CompleteMultipartUploadOptions
 	complete *s3.CompletedMultipartUpload
-	buf      *bytes.Buffer
+	// buf buffer of the next part, its capacity is acquired from the memory budget
+	buf   []byte
+	mutex sync.Mutex
+	// closed the upload is completed or aborted
+	closed bool
+	// err error of the aborted upload
+	err error
+	// done closed when the upload is completed or aborted
+	done chan struct{}
+	// save saves the checkpoint, the writer is resumable if it's not nil
+	save api2.CheckpointFunc
+	// parts uploaded parts of the checkpoint
+	parts []api2.CheckpointPart
+	// resumed parts uploaded before resuming, keyed by the part number
+	resumed map[int64]api2.CheckpointPart
+	// slots in-flight parts of the writer
+	slots chan struct{}
+	// wg in-flight parts
+	wg sync.WaitGroup
+	// partsMutex guards complete, parts and partErr, which are updated by in-flight parts
+	partsMutex sync.Mutex
+	// partErr the first error of in-flight parts
+	partErr error
+	// partSize size of the first parts
+	partSize int64
+	// growing the part size doubles every partGrowth parts, for content of unknown size
+	growing bool
+	// sha256 hex encoded sha256 of the whole content, empty if it's unknown
+	sha256 string
+	// options headers, metadata and tags of the object
+	options *api2.Options
+	// bufWeight memory of buf acquired from the budget
+	bufWeight int64
 }
 
 func (o *ossWriter) Write(p []byte) (n int, err error) {
-	_, err = o.buf.Write(p)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return 0, o.closedErr()
+	}
+	for len(p) > 0 {
+		// parts are cut at the part size, so the parts of a resumed upload are the same. The
+		// last part is kept until more data is written, files of one part are put by Close.
+		if o.buf != nil && len(o.buf) == cap(o.buf) {
+			err = o.submitBuffer()
+		} else if o.buf == nil {
+			err = o.allocate(o.nextPartSize())
+		}
+		if err != nil {
+			o.fail(err)
+			return n, err
+		}
+		c := copy(o.buf[len(o.buf):cap(o.buf)], p)
+		o.buf = o.buf[:len(o.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// allocate acquire the buffer of the next part from the memory budget, the mutex must be held
+func (o *ossWriter) allocate(size int64) error {
+	err := o.s.memory.Acquire(o.ctx, size)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if o.buf.Len() < o.s.blockSize {
-		return len(p), nil
+	o.buf = make([]byte, 0, size)
+	o.bufWeight = size
+	return nil
+}
+
+// releaseBuffer drop the buffer and release its memory, the mutex must be held
+func (o *ossWriter) releaseBuffer() {
+	o.s.memory.Release(o.bufWeight)
+	o.buf = nil
+	o.bufWeight = 0
+}
+
+// submitBuffer upload the buffered part in background, the buffer and its memory are handed
+// over to the part, the mutex must be held
+func (o *ossWriter) submitBuffer() error {
+	buf, weight := o.buf, o.bufWeight
+	o.buf = nil
+	o.bufWeight = 0
+	return o.submit(
+		weight, func(partNumber int64) error {
+			return o.uploadPart(partNumber, buf)
+		},
+	)
+}
+
+// nextPartSize returns the size of the next part, the part size of content of unknown size
+// doubles every partGrowth parts up to api.MaxPartSize and the memory budget
+func (o *ossWriter) nextPartSize() int64 {
+	if !o.growing {
+		return o.partSize
+	}
+	size := o.partSize << uint((o.partNumber-1)/partGrowth)
+	if size > api2.MaxPartSize || size <= 0 {
+		size = api2.MaxPartSize
+	}
+	if size > o.s.memoryLimit && o.s.memoryLimit >= o.partSize {
+		size = o.s.memoryLimit
+	}
+	return size
+}
+
+// start create the multipart upload before the first part, the mutex must be held
+func (o *ossWriter) start() error {
+	if o.upload != nil {
+		return nil
 	}
-	err = o.uploadPart(o.buf.Bytes())
+	upload, err := o.service.CreateMultipartUploadWithContext(
+		o.ctx, &s3.CreateMultipartUploadInput{
+			Bucket:          aws.String(o.s.bucket),
+			Key:             aws.String(o.name),
+			ContentType:     optionalString(o.options.Mimetype),
+			ContentEncoding: optionalString(o.options.ContentEncoding),
+			CacheControl:    optionalString(o.options.CacheControl),
+			Metadata:        metadata(o.options.Metadata, o.sha256),
+			Tagging:         tagging(o.options.Tags),
+		},
+	)
+	// upload, _, err := s.client.Object.InitiateMultipartUpload(ctx, path, nil)
 	if err != nil {
-		return 0, err
+		logger.ContextLog(o.ctx).Errorf("failed to init upload, err: %v", err.Error())
+		return wrap("create", o.name, err)
+	}
+	o.upload = upload
+	o.s.track(aws.StringValue(upload.UploadId), o.done)
+	if o.save != nil {
+		o.save(o.checkpoint())
 	}
-	o.buf = &bytes.Buffer{}
-	return len(p), nil
+	return nil
 }
 
-func (o *ossWriter) uploadPart(reader []byte) error {
-	log := logger.ContextLog(o.ctx)
+// put put the buffered content by a single request, the mutex must be held
+func (o *ossWriter) put() error {
+	data := o.buf
+	sum := md5.Sum(data)
+	if o.sha256 == "" {
+		h := sha256.Sum256(data)
+		o.sha256 = hex.EncodeToString(h[:])
+	}
+	resp, err := o.service.PutObjectWithContext(
+		o.ctx, &s3.PutObjectInput{
+			Bucket:          aws.String(o.s.bucket),
+			Key:             aws.String(o.name),
+			Body:            bytes.NewReader(data),
+			ContentMD5:      aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+			ContentType:     optionalString(o.options.Mimetype),
+			ContentEncoding: optionalString(o.options.ContentEncoding),
+			CacheControl:    optionalString(o.options.CacheControl),
+			Metadata:        metadata(o.options.Metadata, o.sha256),
+			Tagging:         tagging(o.options.Tags),
+		},
+	)
+	if err != nil {
+		return wrap("put", o.name, err)
+	}
+	if o.s.skipETagCheck {
+		return nil
+	}
+	return checkETag(
+		o.name, resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm, sum[:],
+	)
+}
 
-	br := bytes.NewReader(reader)
+// submit run the upload of the next part in background, the memory of the weight is held by
+// the part and released after the upload. It blocks until a slot of the writer is available,
+// and returns the error of the failed parts.
+func (o *ossWriter) submit(weight int64, upload func(partNumber int64) error) error {
+	err := o.partError()
+	if err == nil {
+		err = o.start()
+	}
+	if err == nil {
+		select {
+		case o.slots <- struct{}{}:
+		case <-o.ctx.Done():
+			err = o.ctx.Err()
+		}
+	}
+	if err != nil {
+		o.s.memory.Release(weight)
+		return err
+	}
 	partNumber := o.partNumber
-	resp, err := o.service.UploadPart(
-		&s3.UploadPartInput{
-			Body:       br,
+	o.partNumber++
+	o.wg.Add(1)
+	go func() {
+		defer func() {
+			o.s.memory.Release(weight)
+			<-o.slots
+			o.wg.Done()
+		}()
+		err := upload(partNumber)
+		if err != nil {
+			o.partsMutex.Lock()
+			if o.partErr == nil {
+				o.partErr = err
+			}
+			o.partsMutex.Unlock()
+		}
+	}()
+	return nil
+}
+
+// readFrom upload the parts of the reader, parts are read in background. Parts within the memory
+// budget are buffered, larger parts are streamed from the reader.
+func (o *ossWriter) readFrom(reader io.ReaderAt, size int64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return o.closedErr()
+	}
+	partSize := o.partSize
+	if o.upload == nil && size <= partSize {
+		// put by Close
+		err := o.allocate(size)
+		if err == nil {
+			o.buf = o.buf[:size]
+			err = readFull(reader, o.buf, 0)
+		}
+		if err != nil {
+			o.fail(err)
+			return err
+		}
+		return nil
+	}
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		offset := offset
+		var err error
+		if n > o.s.memoryLimit {
+			err = o.submit(
+				0, func(partNumber int64) error {
+					return o.streamPart(partNumber, io.NewSectionReader(reader, offset, n))
+				},
+			)
+		} else if err = o.s.memory.Acquire(o.ctx, n); err == nil {
+			err = o.submit(
+				n, func(partNumber int64) error {
+					buf := make([]byte, n)
+					if err := readFull(reader, buf, offset); err != nil {
+						return err
+					}
+					return o.uploadPart(partNumber, buf)
+				},
+			)
+		}
+		if err != nil {
+			o.fail(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// readFull read len(p) bytes at the offset, the content is truncated if the reader ends early
+func readFull(reader io.ReaderAt, p []byte, offset int64) error {
+	n, err := reader.ReadAt(p, offset)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// partError returns the first error of the in-flight parts
+func (o *ossWriter) partError() error {
+	o.partsMutex.Lock()
+	defer o.partsMutex.Unlock()
+	return o.partErr
+}
+
+// wait wait for the in-flight parts, returns the first error of them
+func (o *ossWriter) wait() error {
+	o.wg.Wait()
+	return o.partError()
+}
+
+// uploadPart upload the buffered part
+func (o *ossWriter) uploadPart(partNumber int64, data []byte) error {
+	sum := md5.Sum(data)
+	return o.uploadBody(partNumber, bytes.NewReader(data), int64(len(data)), sum[:])
+}
+
+// streamPart upload the part of the section without buffering it, the section is read for the
+// md5 before the request
+func (o *ossWriter) streamPart(partNumber int64, section *io.SectionReader) error {
+	h := md5.New()
+	n, err := io.Copy(h, section)
+	if err == nil && n != section.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	_, err = section.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return o.uploadBody(partNumber, section, n, h.Sum(nil))
+}
+
+// uploadBody upload the part of the body with the md5 of its content, parts of the resumed
+// upload with the same content are skipped
+func (o *ossWriter) uploadBody(partNumber int64, body io.ReadSeeker, size int64, sum []byte) error {
+	log := logger.ContextLog(o.ctx)
+	part := api2.CheckpointPart{
+		Number: partNumber,
+		Size:   size,
+		MD5:    hex.EncodeToString(sum),
+	}
+	if resumed, ok := o.resumed[partNumber]; ok && resumed.MD5 == part.MD5 &&
+		resumed.Size == part.Size {
+		log.Debugf("part: %v of upload: %v is uploaded, skip it", partNumber, *o.upload.UploadId)
+		part.ETag = resumed.ETag
+		o.addPart(part)
+		return nil
+	}
+	resp, err := o.service.UploadPartWithContext(
+		o.ctx, &s3.UploadPartInput{
+			Body:       body,
 			Bucket:     o.upload.Bucket,
 			Key:        aws.String(o.name),
 			PartNumber: aws.Int64(partNumber),
 			UploadId:   o.upload.UploadId,
+			ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum)),
 		},
 	)
 
@@ -175,31 +717,188 @@ func (o *ossWriter) uploadPart(reader []byte) error {
 			"failed to upload part uploadId: %v, error: %v", *o.upload.UploadId,
 			err.Error(),
 		)
+		return wrap("upload", o.name, err)
+	}
+	if !o.s.skipETagCheck {
+		err = checkETag(
+			o.name, resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm, sum,
+		)
+	}
+	if err != nil {
+		log.Errorf(
+			"failed to upload part: %v of uploadId: %v, error: %v", partNumber,
+			*o.upload.UploadId, err.Error(),
+		)
 		return err
 	}
+	part.ETag = strings.Trim(aws.StringValue(resp.ETag), "\"")
+	o.addPart(part)
+	return nil
+}
+
+// checkETag returns an error if the etag of the response isn't the md5 of the uploaded content.
+// Etags of objects encrypted by KMS or by customer keys (SSE-C) aren't md5, and aren't checked.
+func checkETag(
+	path string, etag *string, encryption *string, customerAlgorithm *string, sum []byte,
+) error {
+	switch aws.StringValue(encryption) {
+	case s3.ServerSideEncryptionAwsKms, "aws:kms:dsse":
+		return nil
+	}
+	if aws.StringValue(customerAlgorithm) != "" {
+		return nil
+	}
+	e := strings.Trim(aws.StringValue(etag), "\"")
+	if len(e) != hex.EncodedLen(md5.Size) || e == hex.EncodeToString(sum) {
+		return nil
+	}
+	return api2.Wrap(
+		"upload", path, api2.ErrTransient,
+		fmt.Errorf("etag: %v isn't the md5: %x of the content", e, sum),
+	)
+}
+
+// metadata returns the object metadata of the user metadata, and the sha256 of the content
+// which replaces the user metadata of the same key
+func metadata(user map[string]string, sum string) map[string]*string {
+	if len(user) == 0 && sum == "" {
+		return nil
+	}
+	m := make(map[string]*string, len(user)+1)
+	for k, v := range user {
+		m[strings.ToLower(k)] = aws.String(v)
+	}
+	if sum != "" {
+		m[sha256Metadata] = aws.String(sum)
+	}
+	return m
+}
+
+// metadataValue returns the value of the metadata key, keys of responses are canonicalized
+func metadataValue(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// userMetadata returns the user metadata of the response with lower case keys, the sha256 of
+// the content is excluded
+func userMetadata(metadata map[string]*string) map[string]string {
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if k = strings.ToLower(k); k != sha256Metadata {
+			m[k] = aws.StringValue(v)
+		}
+	}
+	return m
+}
+
+// tagging returns the url encoded tags of the Tagging header, nil if there are no tags
+func tagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// optionalString returns nil if the value is empty, so the header isn't sent
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// storageClass returns the storage class of the object, S3 omits the standard class
+func storageClass(class *string) string {
+	if aws.StringValue(class) == "" {
+		return s3.StorageClassStandard
+	}
+	return aws.StringValue(class)
+}
+
+// addPart add the uploaded part to the completed parts and save the checkpoint, parts are kept
+// in the order of the part number
+func (o *ossWriter) addPart(part api2.CheckpointPart) {
+	o.partsMutex.Lock()
+	defer o.partsMutex.Unlock()
 	o.complete.Parts = append(
 		o.complete.Parts, &s3.CompletedPart{
-			ETag:       resp.ETag,
-			PartNumber: aws.Int64(partNumber),
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		},
+	)
+	sort.Slice(
+		o.complete.Parts, func(i, j int) bool {
+			return *o.complete.Parts[i].PartNumber < *o.complete.Parts[j].PartNumber
 		},
 	)
+	if o.save != nil {
+		o.parts = append(o.parts, part)
+		sort.Slice(
+			o.parts, func(i, j int) bool {
+				return o.parts[i].Number < o.parts[j].Number
+			},
+		)
+		o.save(o.checkpoint())
+	}
+}
 
-	o.partNumber++
-	return nil
+// checkpoint returns the checkpoint of the uploaded parts
+func (o *ossWriter) checkpoint() *api2.Checkpoint {
+	return &api2.Checkpoint{
+		UploadID: aws.StringValue(o.upload.UploadId),
+		PartSize: o.partSize,
+		Parts:    append([]api2.CheckpointPart(nil), o.parts...),
+		SHA256:   o.sha256,
+	}
 }
 
 func (o *ossWriter) Close() error {
 	log := logger.ContextLog(o.ctx)
-	if o.buf.Len() > 0 {
-		err := o.uploadPart(o.buf.Bytes())
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return o.err
+	}
+	if o.upload == nil {
+		err := o.put()
+		if err != nil {
+			log.Errorf("failed to put object: %v, error: %v", o.name, err.Error())
+			o.fail(err)
+			return err
+		}
+		o.releaseBuffer()
+		o.closed = true
+		close(o.done)
+		return nil
+	}
+	// an empty file of a resumed upload is uploaded as an empty part, complete requires at
+	// least one part
+	if len(o.buf) > 0 || o.partNumber == 1 {
+		err := o.submitBuffer()
 		if err != nil {
 			log.Errorf("failed to close stream, error: %v", err.Error())
+			o.fail(err)
 			return err
 		}
 	}
+	err := o.wait()
+	if err != nil {
+		log.Errorf("failed to close stream, error: %v", err.Error())
+		o.fail(err)
+		return err
+	}
 
-	_, err := o.service.CompleteMultipartUpload(
-		&s3.CompleteMultipartUploadInput{
+	_, err = o.service.CompleteMultipartUploadWithContext(
+		o.ctx, &s3.CompleteMultipartUploadInput{
 			Bucket:          o.upload.Bucket,
 			Key:             aws.String(o.name),
 			MultipartUpload: o.complete,
@@ -209,39 +908,119 @@ func (o *ossWriter) Close() error {
 
 	if err != nil {
 		log.Errorf("failed to close stream, error: %v", err.Error())
+		err = wrap("complete", o.name, err)
+		o.fail(err)
 		return err
 	}
+	o.closed = true
+	close(o.done)
 	return nil
 }
 
+// Abort abort the upload, the uploaded parts are removed and the file isn't created or changed
+func (o *ossWriter) Abort() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return nil
+	}
+	return o.abort(errAborted)
+}
+
+// abortOnCancel abort the upload if the context is canceled before the upload is done
+func (o *ossWriter) abortOnCancel() {
+	select {
+	case <-o.ctx.Done():
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		if !o.closed {
+			o.fail(o.ctx.Err())
+		}
+	case <-o.done:
+	}
+}
+
+// fail close the writer because of the error, the upload is aborted unless it's resumable,
+// the mutex must be held
+func (o *ossWriter) fail(err error) {
+	if o.save == nil {
+		_ = o.abort(err)
+		return
+	}
+	o.releaseBuffer()
+	o.closed = true
+	o.err = err
+	close(o.done)
+	// the checkpoints of in-flight parts are saved before the writer is retried
+	_ = o.wait()
+}
+
+// abort abort the multipart upload because of the error, the mutex must be held. The upload is
+// aborted by a new context, the context of the writer may be canceled already. In-flight parts
+// are waited, so they won't be uploaded after the upload is aborted.
+func (o *ossWriter) abort(err error) error {
+	o.releaseBuffer()
+	o.closed = true
+	o.err = err
+	close(o.done)
+	_ = o.wait()
+	if o.upload == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	_, err = o.service.AbortMultipartUploadWithContext(
+		ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   o.upload.Bucket,
+			Key:      aws.String(o.name),
+			UploadId: o.upload.UploadId,
+		},
+	)
+	if err != nil {
+		logger.ContextLog(o.ctx).Errorf(
+			"failed to abort upload: %v, error: %v", aws.StringValue(o.upload.UploadId),
+			err.Error(),
+		)
+		return wrap("abort", o.name, err)
+	}
+	return nil
+}
+
+// closedErr returns the error of writing to the closed writer
+func (o *ossWriter) closedErr() error {
+	if o.err != nil {
+		return o.err
+	}
+	return errClosed
+}
+
 func (s *storage) Info(ctx context.Context, path string) (*api2.FileInfo, error) {
-	log := logger.ContextLog(ctx)
-	service := s3.New(s.sess)
-	resp, err := service.GetObject(
-		&s3.GetObjectInput{
+	service := s.client
+	resp, err := service.HeadObjectWithContext(
+		ctx, &s3.HeadObjectInput{
 			Bucket: aws.String(s.bucket),
 			Key:    aws.String(path),
 		},
 	)
 	if err != nil {
-		return nil, err
+		return nil, wrap("info", path, err)
 	}
-	defer func() {
-		err2 := resp.Body.Close()
-		if err2 != nil {
-			log.Errorf("failed to close body, err: %v", err2.Error())
-		}
-	}()
 	fileInfo := &api2.FileInfo{
-		Path:     path,
-		FileName: fs.FileName(path),
-		Size:     *resp.ContentLength,
+		Path:         path,
+		FileName:     fs.FileName(path),
+		Size:         aws.Int64Value(resp.ContentLength),
+		ModTime:      aws.TimeValue(resp.LastModified),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), "\""),
+		SHA256:       metadataValue(resp.Metadata, sha256Metadata),
+		ContentType:  aws.StringValue(resp.ContentType),
+		Metadata:     userMetadata(resp.Metadata),
+		StorageClass: storageClass(resp.StorageClass),
 	}
 	return fileInfo, nil
 }
 
 func (s *storage) CreateUploadURL(ctx context.Context, path string, expire time.Duration) (string, error) {
-	service := s3.New(s.sess)
+	service := s.client
 	req, _ := service.PutObjectRequest(
 		&s3.PutObjectInput{
 			Bucket: aws.String(s.bucket),
@@ -251,3 +1030,425 @@ func (s *storage) CreateUploadURL(ctx context.Context, path string, expire time.
 
 	return req.Presign(expire)
 }
+
+func (s *storage) Delete(ctx context.Context, path string) error {
+	log := logger.ContextLog(ctx)
+	service := s.client
+	_, err := service.DeleteObjectWithContext(
+		ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(objectKey(path)),
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to delete object: %v, error: %v", path, err.Error())
+		return wrap("delete", path, err)
+	}
+	return nil
+}
+
+func (s *storage) DeleteAll(ctx context.Context, prefix string) error {
+	log := logger.ContextLog(ctx)
+	service := s.client
+	p := objectKey(prefix)
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(p),
+	}
+	var deleteErr error
+	err := service.ListObjectsV2PagesWithContext(
+		ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+			for _, content := range page.Contents {
+				objects = append(objects, &s3.ObjectIdentifier{Key: content.Key})
+			}
+			deleteErr = s.deleteObjects(ctx, service, objects)
+			return deleteErr == nil
+		},
+	)
+	if err == nil {
+		err = deleteErr
+	}
+	if err != nil {
+		log.Errorf("failed to delete prefix: %v, error: %v", prefix, err.Error())
+		return wrap("delete", prefix, err)
+	}
+	return nil
+}
+
+func (s *storage) deleteObjects(
+	ctx context.Context, service s3iface.S3API, objects []*s3.ObjectIdentifier,
+) error {
+	for len(objects) > 0 {
+		n := len(objects)
+		if n > maxDeleteObjects {
+			n = maxDeleteObjects
+		}
+		resp, err := service.DeleteObjectsWithContext(
+			ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(s.bucket),
+				Delete: &s3.Delete{
+					Objects: objects[:n],
+					Quiet:   aws.Bool(true),
+				},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if len(resp.Errors) > 0 {
+			e := resp.Errors[0]
+			return awserr.New(
+				aws.StringValue(e.Code), fmt.Sprintf(
+					"failed to delete object: %v, message: %v", aws.StringValue(e.Key),
+					aws.StringValue(e.Message),
+				), nil,
+			)
+		}
+		objects = objects[n:]
+	}
+	return nil
+}
+
+func (s *storage) Copy(ctx context.Context, src string, dst string) error {
+	log := logger.ContextLog(ctx)
+	service := s.client
+	head, err := service.HeadObjectWithContext(
+		ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(src),
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to head object: %v, error: %v", src, err.Error())
+		return wrap("copy", src, err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if size <= maxCopyObjectSize {
+		_, err = service.CopyObjectWithContext(
+			ctx, &s3.CopyObjectInput{
+				Bucket:           aws.String(s.bucket),
+				Key:              aws.String(dst),
+				CopySource:       aws.String(s.copySource(src)),
+				TaggingDirective: aws.String(s3.TaggingDirectiveCopy),
+			},
+		)
+	} else {
+		err = s.copyMultipart(ctx, service, src, dst, head)
+	}
+	if err != nil {
+		log.Errorf("failed to copy object: %v to: %v, error: %v", src, dst, err.Error())
+		return wrap("copy", src, err)
+	}
+	return nil
+}
+
+// copyMultipart copy the object by parts, the metadata and the tags of the source are copied.
+// The upload is aborted if the copy fails, so no parts are left.
+func (s *storage) copyMultipart(
+	ctx context.Context, service s3iface.S3API, src string, dst string, head *s3.HeadObjectOutput,
+) (err error) {
+	size := aws.Int64Value(head.ContentLength)
+	partSize := int64(copyPartSize)
+	if size/partSize >= api2.MaxParts {
+		partSize = size/api2.MaxParts + 1
+	}
+	tags, err := service.GetObjectTaggingWithContext(
+		ctx, &s3.GetObjectTaggingInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(src),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	upload, err := service.CreateMultipartUploadWithContext(
+		ctx, &s3.CreateMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dst),
+			ContentType:     head.ContentType,
+			ContentEncoding: head.ContentEncoding,
+			CacheControl:    head.CacheControl,
+			Metadata:        head.Metadata,
+			StorageClass:    head.StorageClass,
+			Tagging:         tagging(tagMap(tags.TagSet)),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	s.track(aws.StringValue(upload.UploadId), done)
+	defer func() {
+		if err != nil {
+			s.abortCopy(ctx, service, dst, upload.UploadId)
+		}
+	}()
+	complete := &s3.CompletedMultipartUpload{}
+	var partNumber int64 = 1
+	for offset := int64(0); offset < size; offset += partSize {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		var resp *s3.UploadPartCopyOutput
+		resp, err = service.UploadPartCopyWithContext(
+			ctx, &s3.UploadPartCopyInput{
+				Bucket:          aws.String(s.bucket),
+				Key:             aws.String(dst),
+				CopySource:      aws.String(s.copySource(src)),
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+				PartNumber:      aws.Int64(partNumber),
+				UploadId:        upload.UploadId,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(
+			complete.Parts, &s3.CompletedPart{
+				ETag:       resp.CopyPartResult.ETag,
+				PartNumber: aws.Int64(partNumber),
+			},
+		)
+		partNumber++
+	}
+	_, err = service.CompleteMultipartUploadWithContext(
+		ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dst),
+			MultipartUpload: complete,
+			UploadId:        upload.UploadId,
+		},
+	)
+	return err
+}
+
+// abortCopy abort the multipart upload of the failed copy by a new context, the context of the
+// copy may be canceled already
+func (s *storage) abortCopy(
+	ctx context.Context, service s3iface.S3API, dst string, uploadID *string,
+) {
+	abortCtx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	_, err := service.AbortMultipartUploadWithContext(
+		abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(dst),
+			UploadId: uploadID,
+		},
+	)
+	if err != nil {
+		logger.ContextLog(ctx).Errorf(
+			"failed to abort upload: %v, error: %v", aws.StringValue(uploadID), err.Error(),
+		)
+	}
+}
+
+// tagMap returns the tags of the tag set
+func tagMap(tagSet []*s3.Tag) map[string]string {
+	tags := make(map[string]string, len(tagSet))
+	for _, tag := range tagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags
+}
+
+func (s *storage) Move(ctx context.Context, src string, dst string) error {
+	err := s.Copy(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, src)
+}
+
+// track keep the upload active until done is closed
+func (s *storage) track(uploadID string, done <-chan struct{}) {
+	s.activeMutex.Lock()
+	if s.active == nil {
+		s.active = make(map[string]int)
+	}
+	s.active[uploadID]++
+	s.activeMutex.Unlock()
+	go func() {
+		<-done
+		s.activeMutex.Lock()
+		defer s.activeMutex.Unlock()
+		if s.active[uploadID]--; s.active[uploadID] <= 0 {
+			delete(s.active, uploadID)
+		}
+	}()
+}
+
+// activeUpload returns true if the upload is in progress
+func (s *storage) activeUpload(uploadID string) bool {
+	s.activeMutex.Lock()
+	defer s.activeMutex.Unlock()
+	return s.active[uploadID] > 0
+}
+
+// AbortUploads abort multipart uploads under the prefix which are initiated before the time,
+// they are left by crashed processes and their parts are billed until aborted. Uploads of the
+// writers and copies in progress are kept.
+func (s *storage) AbortUploads(
+	ctx context.Context, prefix string, before time.Time,
+	match func(path, uploadID string) bool,
+) (int, error) {
+	log := logger.ContextLog(ctx)
+	service := s.client
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(objectKey(prefix)),
+	}
+	aborted := 0
+	var abortErr error
+	err := service.ListMultipartUploadsPagesWithContext(
+		ctx, input, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				id := aws.StringValue(upload.UploadId)
+				if !aws.TimeValue(upload.Initiated).Before(before) || s.activeUpload(id) ||
+					match != nil && !match("/"+aws.StringValue(upload.Key), id) {
+					continue
+				}
+				log.Infof(
+					"abort upload: %v of object: %v initiated at: %v",
+					aws.StringValue(upload.UploadId), aws.StringValue(upload.Key),
+					aws.TimeValue(upload.Initiated),
+				)
+				_, abortErr = service.AbortMultipartUploadWithContext(
+					ctx, &s3.AbortMultipartUploadInput{
+						Bucket:   aws.String(s.bucket),
+						Key:      upload.Key,
+						UploadId: upload.UploadId,
+					},
+				)
+				if errorKind(abortErr) == api2.ErrNotExist {
+					// completed or aborted by others
+					abortErr = nil
+					continue
+				}
+				if abortErr != nil {
+					return false
+				}
+				aborted++
+			}
+			return true
+		},
+	)
+	if err == nil {
+		err = abortErr
+	}
+	if err != nil {
+		log.Errorf("failed to abort uploads of prefix: %v, error: %v", prefix, err.Error())
+		return aborted, wrap("abort", prefix, err)
+	}
+	return aborted, nil
+}
+
+func (s *storage) List(
+	ctx context.Context, prefix string, opts *api2.ListOptions,
+) (*api2.ListResult, error) {
+	log := logger.ContextLog(ctx)
+	if opts == nil {
+		opts = &api2.ListOptions{}
+	}
+	maxKeys := opts.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = api2.DefaultMaxKeys
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(objectKey(prefix)),
+		MaxKeys: aws.Int64(int64(maxKeys)),
+	}
+	if opts.Token != "" {
+		input.ContinuationToken = aws.String(opts.Token)
+	}
+	service := s.client
+	resp, err := service.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		log.Errorf("failed to list objects of prefix: %v, error: %v", prefix, err.Error())
+		return nil, wrap("list", prefix, err)
+	}
+	result := &api2.ListResult{
+		Files: make([]*api2.FileInfo, 0, len(resp.Contents)),
+	}
+	for _, content := range resp.Contents {
+		path := "/" + aws.StringValue(content.Key)
+		result.Files = append(
+			result.Files, &api2.FileInfo{
+				Path:         path,
+				FileName:     fs.FileName(path),
+				Size:         aws.Int64Value(content.Size),
+				ModTime:      aws.TimeValue(content.LastModified),
+				ETag:         strings.Trim(aws.StringValue(content.ETag), "\""),
+				StorageClass: storageClass(content.StorageClass),
+			},
+		)
+	}
+	if aws.BoolValue(resp.IsTruncated) {
+		result.NextToken = aws.StringValue(resp.NextContinuationToken)
+	}
+	return result, nil
+}
+
+// copySource returns the url encoded copy source of the path
+func (s *storage) copySource(path string) string {
+	segments := strings.Split(s.bucket+"/"+objectKey(path), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// objectKey returns the key of the path, the sdk cleans the leading slash of the request uri,
+// so keys which are sent in headers or bodies must be cleaned the same way.
+func objectKey(path string) string {
+	return strings.TrimLeft(path, "/")
+}
+
+// wrap wrap the error of the sdk into api.Error by the status code or the error code
+func wrap(op string, path string, err error) error {
+	return api2.Wrap(op, path, errorKind(err), err)
+}
+
+func errorKind(err error) error {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		switch e.StatusCode() {
+		case http.StatusNotFound:
+			return api2.ErrNotExist
+		case http.StatusForbidden, http.StatusUnauthorized:
+			return api2.ErrPermission
+		case http.StatusConflict, http.StatusPreconditionFailed:
+			return api2.ErrConflict
+		case http.StatusTooManyRequests:
+			return api2.ErrThrottled
+		case http.StatusServiceUnavailable:
+			if e.Code() == "SlowDown" {
+				return api2.ErrThrottled
+			}
+			return api2.ErrTransient
+		case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusGatewayTimeout:
+			return api2.ErrTransient
+		}
+	}
+	if e, ok := err.(awserr.Error); ok {
+		switch e.Code() {
+		case "NoSuchKey", "NoSuchBucket", "NoSuchUpload", "NotFound":
+			return api2.ErrNotExist
+		case "AccessDenied":
+			return api2.ErrPermission
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return api2.ErrThrottled
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, "RequestTimeout",
+			"InternalError", "BadDigest":
+			return api2.ErrTransient
+		}
+	}
+	return nil
+}
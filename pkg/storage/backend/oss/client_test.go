@@ -18,7 +18,7 @@ func Examplestorage_CreateUploadURL() {
 			Bucket:    "bucketxxx",
 			SecretID:  "[secret_id]",
 			SecretKey: "[secret_key]",
-		}, 1024*1024, true,
+		}, 5*1024*1024, true,
 	)
 	if err != nil {
 		panic(err)
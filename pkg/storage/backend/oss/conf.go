@@ -6,4 +6,12 @@ type Conf struct {
 	Bucket    string
 	SecretID  string
 	SecretKey string
+	// Concurrency in-flight parts of an upload, defaultConcurrency is used if it's not positive
+	Concurrency int
+	// MemoryLimit bytes of the buffers of in-flight parts of all uploads, defaultMemoryLimit is
+	// used if it's not positive, and it's raised to the block size if it's less
+	MemoryLimit int64
+	// SkipETagCheck don't compare the etags of uploads with the md5 of the content, etags of some
+	// S3 compatible stores aren't md5. The content is still validated by the Content-MD5.
+	SkipETagCheck bool
 }
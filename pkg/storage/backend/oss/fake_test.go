@@ -0,0 +1,544 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 in-process stub of the S3 api used by the storage, objects and multipart uploads are
+// kept in memory. Bodies of PutObject and UploadPart must carry the Content-MD5 of the content.
+type fakeS3 struct {
+	s3iface.S3API
+	mutex   sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+	// operations names of the requests in order
+	operations []string
+	// beforePart called before the part is stored, the part fails if it returns an error
+	beforePart func(input *s3.UploadPartInput) error
+	// copyErr error of UploadPartCopy if it's not nil
+	copyErr error
+	// etag etag of the responses of PutObject and UploadPart instead of the md5 if it's not empty
+	etag string
+}
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modTime  time.Time
+	headers  *s3.CreateMultipartUploadInput
+	metadata map[string]*string
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	headers   *s3.CreateMultipartUploadInput
+	parts     map[int64]*fakePart
+}
+
+type fakePart struct {
+	data []byte
+	etag string
+}
+
+// newFakeStorage create the storage of the fake S3
+func newFakeStorage(t *testing.T) (*storage, *fakeS3) {
+	s, err := NewOssStorage(
+		&Conf{Endpoint: "http://127.0.0.1:9000", Bucket: "fsync-test"}, testBlockSize, false,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fake := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+	s.(*storage).client = fake
+	return s.(*storage), fake
+}
+
+func fakeError(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "fake")
+}
+
+// begin record the operation, and fail it if the context is canceled
+func (f *fakeS3) begin(ctx context.Context, operation string) error {
+	f.mutex.Lock()
+	f.operations = append(f.operations, operation)
+	f.mutex.Unlock()
+	if ctx.Err() != nil {
+		return awserr.New(request.CanceledErrorCode, "request canceled", ctx.Err())
+	}
+	return nil
+}
+
+// Operations returns the names of the recorded requests and clears them
+func (f *fakeS3) Operations() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	operations := f.operations
+	f.operations = nil
+	return operations
+}
+
+// readBody read the body and check it against the Content-MD5
+func readBody(body io.ReadSeeker, contentMD5 *string) ([]byte, string, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := md5.Sum(data)
+	if contentMD5 == nil {
+		return nil, "", fakeError("MissingContentMD5", http.StatusBadRequest)
+	}
+	if *contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, "", fakeError("BadDigest", http.StatusBadRequest)
+	}
+	return data, hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalMetadata returns the metadata with canonical keys like the responses of S3
+func canonicalMetadata(metadata map[string]*string) map[string]*string {
+	m := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		m[http.CanonicalHeaderKey(k)] = v
+	}
+	return m
+}
+
+func (f *fakeS3) PutObjectWithContext(
+	ctx aws.Context, input *s3.PutObjectInput, _ ...request.Option,
+) (*s3.PutObjectOutput, error) {
+	if err := f.begin(ctx, "PutObject"); err != nil {
+		return nil, err
+	}
+	data, etag, err := readBody(input.Body, input.ContentMD5)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.objects[objectKey(aws.StringValue(input.Key))] = &fakeObject{
+		data:    data,
+		etag:    etag,
+		modTime: time.Now(),
+		headers: &s3.CreateMultipartUploadInput{
+			ContentType: input.ContentType, ContentEncoding: input.ContentEncoding,
+			CacheControl: input.CacheControl, Tagging: input.Tagging,
+		},
+		metadata: canonicalMetadata(input.Metadata),
+	}
+	return &s3.PutObjectOutput{ETag: aws.String("\"" + f.responseETag(etag) + "\"")}, nil
+}
+
+// responseETag returns the etag of responses, f.etag overrides the etag of the content
+func (f *fakeS3) responseETag(etag string) string {
+	if f.etag != "" {
+		return f.etag
+	}
+	return etag
+}
+
+// object returns the object of the key
+func (f *fakeS3) object(key *string) (*fakeObject, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object, ok := f.objects[objectKey(aws.StringValue(key))]
+	if !ok {
+		return nil, fakeError("NoSuchKey", http.StatusNotFound)
+	}
+	return object, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(
+	ctx aws.Context, input *s3.GetObjectInput, _ ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	if err := f.begin(ctx, "GetObject"); err != nil {
+		return nil, err
+	}
+	object, err := f.object(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(object.data))}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(
+	ctx aws.Context, input *s3.HeadObjectInput, _ ...request.Option,
+) (*s3.HeadObjectOutput, error) {
+	if err := f.begin(ctx, "HeadObject"); err != nil {
+		return nil, err
+	}
+	object, err := f.object(input.Key)
+	if err != nil {
+		return nil, fakeError("NotFound", http.StatusNotFound)
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength:   aws.Int64(int64(len(object.data))),
+		ETag:            aws.String("\"" + object.etag + "\""),
+		LastModified:    aws.Time(object.modTime),
+		ContentType:     object.headers.ContentType,
+		ContentEncoding: object.headers.ContentEncoding,
+		CacheControl:    object.headers.CacheControl,
+		Metadata:        object.metadata,
+	}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(
+	ctx aws.Context, input *s3.DeleteObjectInput, _ ...request.Option,
+) (*s3.DeleteObjectOutput, error) {
+	if err := f.begin(ctx, "DeleteObject"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.objects, objectKey(aws.StringValue(input.Key)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectsWithContext(
+	ctx aws.Context, input *s3.DeleteObjectsInput, _ ...request.Option,
+) (*s3.DeleteObjectsOutput, error) {
+	if err := f.begin(ctx, "DeleteObjects"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, object := range input.Delete.Objects {
+		delete(f.objects, objectKey(aws.StringValue(object.Key)))
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2WithContext(
+	ctx aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option,
+) (*s3.ListObjectsV2Output, error) {
+	if err := f.begin(ctx, "ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keys := make([]string, 0)
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) &&
+			key > aws.StringValue(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > maxKeys)}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		output.NextContinuationToken = aws.String(keys[maxKeys-1])
+	}
+	for _, key := range keys {
+		object := f.objects[key]
+		output.Contents = append(
+			output.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(object.data))),
+				ETag:         aws.String("\"" + object.etag + "\""),
+				LastModified: aws.Time(object.modTime),
+			},
+		)
+	}
+	return output, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(
+	ctx aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option,
+) error {
+	page := *input
+	for {
+		output, err := f.ListObjectsV2WithContext(ctx, &page)
+		if err != nil {
+			return err
+		}
+		last := !aws.BoolValue(output.IsTruncated)
+		if !fn(output, last) || last {
+			return nil
+		}
+		page.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+func (f *fakeS3) CopyObjectWithContext(
+	ctx aws.Context, input *s3.CopyObjectInput, _ ...request.Option,
+) (*s3.CopyObjectOutput, error) {
+	if err := f.begin(ctx, "CopyObject"); err != nil {
+		return nil, err
+	}
+	object, err := f.source(input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	copied := *object
+	copied.modTime = time.Now()
+	f.objects[objectKey(aws.StringValue(input.Key))] = &copied
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// source returns the object of the copy source
+func (f *fakeS3) source(copySource *string) (*fakeObject, error) {
+	source, err := url.PathUnescape(aws.StringValue(copySource))
+	if err != nil {
+		return nil, err
+	}
+	return f.object(aws.String(source[strings.Index(source, "/")+1:]))
+}
+
+func (f *fakeS3) GetObjectTaggingWithContext(
+	ctx aws.Context, input *s3.GetObjectTaggingInput, _ ...request.Option,
+) (*s3.GetObjectTaggingOutput, error) {
+	if err := f.begin(ctx, "GetObjectTagging"); err != nil {
+		return nil, err
+	}
+	object, err := f.object(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(aws.StringValue(object.headers.Tagging))
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.GetObjectTaggingOutput{TagSet: []*s3.Tag{}}
+	for k := range values {
+		output.TagSet = append(
+			output.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(values.Get(k))},
+		)
+	}
+	return output, nil
+}
+
+func (f *fakeS3) UploadPartCopyWithContext(
+	ctx aws.Context, input *s3.UploadPartCopyInput, _ ...request.Option,
+) (*s3.UploadPartCopyOutput, error) {
+	if err := f.begin(ctx, "UploadPartCopy"); err != nil {
+		return nil, err
+	}
+	if f.copyErr != nil {
+		return nil, f.copyErr
+	}
+	object, err := f.source(input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	var first, last int
+	_, err = fmt.Sscanf(aws.StringValue(input.CopySourceRange), "bytes=%d-%d", &first, &last)
+	if err != nil || last >= len(object.data) {
+		return nil, fakeError("InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+	}
+	data := object.data[first : last+1]
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	upload, err := f.upload(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	upload.parts[aws.Int64Value(input.PartNumber)] = &fakePart{data: data, etag: etag}
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &s3.CopyPartResult{ETag: aws.String("\"" + etag + "\"")},
+	}, nil
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(
+	ctx aws.Context, input *s3.CreateMultipartUploadInput, _ ...request.Option,
+) (*s3.CreateMultipartUploadOutput, error) {
+	if err := f.begin(ctx, "CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{
+		key:       objectKey(aws.StringValue(input.Key)),
+		initiated: time.Now(),
+		headers:   input,
+		parts:     make(map[int64]*fakePart),
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket: input.Bucket, Key: input.Key, UploadId: aws.String(id),
+	}, nil
+}
+
+// upload returns the multipart upload of the id, the mutex must be held
+func (f *fakeS3) upload(id *string) (*fakeUpload, error) {
+	upload, ok := f.uploads[aws.StringValue(id)]
+	if !ok {
+		return nil, fakeError("NoSuchUpload", http.StatusNotFound)
+	}
+	return upload, nil
+}
+
+func (f *fakeS3) UploadPartWithContext(
+	ctx aws.Context, input *s3.UploadPartInput, _ ...request.Option,
+) (*s3.UploadPartOutput, error) {
+	if err := f.begin(ctx, "UploadPart"); err != nil {
+		return nil, err
+	}
+	if f.beforePart != nil {
+		if err := f.beforePart(input); err != nil {
+			return nil, err
+		}
+	}
+	data, etag, err := readBody(input.Body, input.ContentMD5)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	upload, err := f.upload(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	etag = f.responseETag(etag)
+	upload.parts[aws.Int64Value(input.PartNumber)] = &fakePart{data: data, etag: etag}
+	return &s3.UploadPartOutput{ETag: aws.String("\"" + etag + "\"")}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(
+	ctx aws.Context, input *s3.CompleteMultipartUploadInput, _ ...request.Option,
+) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := f.begin(ctx, "CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	upload, err := f.upload(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0)
+	sums := make([]byte, 0)
+	for _, completed := range input.MultipartUpload.Parts {
+		part, ok := upload.parts[aws.Int64Value(completed.PartNumber)]
+		if !ok || strings.Trim(aws.StringValue(completed.ETag), "\"") != part.etag {
+			return nil, fakeError("InvalidPart", http.StatusBadRequest)
+		}
+		data = append(data, part.data...)
+		sum, _ := hex.DecodeString(part.etag)
+		sums = append(sums, sum...)
+	}
+	sum := md5.Sum(sums)
+	f.objects[upload.key] = &fakeObject{
+		data:     data,
+		etag:     fmt.Sprintf("%x-%d", sum, len(input.MultipartUpload.Parts)),
+		modTime:  time.Now(),
+		headers:  upload.headers,
+		metadata: canonicalMetadata(upload.headers.Metadata),
+	}
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUploadWithContext(
+	ctx aws.Context, input *s3.AbortMultipartUploadInput, _ ...request.Option,
+) (*s3.AbortMultipartUploadOutput, error) {
+	if err := f.begin(ctx, "AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, err := f.upload(input.UploadId); err != nil {
+		return nil, err
+	}
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListPartsPagesWithContext(
+	ctx aws.Context, input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool,
+	_ ...request.Option,
+) error {
+	if err := f.begin(ctx, "ListParts"); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	upload, err := f.upload(input.UploadId)
+	output := &s3.ListPartsOutput{}
+	if err == nil {
+		for number, part := range upload.parts {
+			output.Parts = append(
+				output.Parts, &s3.Part{
+					PartNumber: aws.Int64(number),
+					Size:       aws.Int64(int64(len(part.data))),
+					ETag:       aws.String("\"" + part.etag + "\""),
+				},
+			)
+		}
+	}
+	f.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	fn(output, true)
+	return nil
+}
+
+func (f *fakeS3) ListMultipartUploadsPagesWithContext(
+	ctx aws.Context, input *s3.ListMultipartUploadsInput,
+	fn func(*s3.ListMultipartUploadsOutput, bool) bool, _ ...request.Option,
+) error {
+	if err := f.begin(ctx, "ListMultipartUploads"); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	output := &s3.ListMultipartUploadsOutput{}
+	for id, upload := range f.uploads {
+		if strings.HasPrefix(upload.key, aws.StringValue(input.Prefix)) {
+			output.Uploads = append(
+				output.Uploads, &s3.MultipartUpload{
+					Key:       aws.String(upload.key),
+					UploadId:  aws.String(id),
+					Initiated: aws.Time(upload.initiated),
+				},
+			)
+		}
+	}
+	f.mutex.Unlock()
+	fn(output, true)
+	return nil
+}
+
+// Uploads returns the ids of the multipart uploads in progress
+func (f *fakeS3) Uploads() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ids := make([]string, 0, len(f.uploads))
+	for id := range f.uploads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
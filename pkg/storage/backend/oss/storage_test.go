@@ -0,0 +1,808 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+	"github.com/pjoc-team/fsync/pkg/storage/storagetest"
+	"golang.org/x/sync/semaphore"
+)
+
+// testBlockSize min part size of S3
+const testBlockSize = 5 * 1024 * 1024
+
+// newTestStorage create the storage of the S3 compatible service of FSYNC_TEST_S3_ENDPOINT, e.g.
+// a local minio, the fake S3 is used if it's not set.
+func newTestStorage(t *testing.T) *storage {
+	endpoint := os.Getenv("FSYNC_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		s, _ := newFakeStorage(t)
+		return s
+	}
+	conf := &Conf{
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("FSYNC_TEST_S3_BUCKET"),
+		SecretID:  os.Getenv("FSYNC_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("FSYNC_TEST_S3_SECRET_KEY"),
+	}
+	if conf.Bucket == "" {
+		conf.Bucket = "fsync-test"
+	}
+	s, err := NewOssStorage(conf, testBlockSize, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = s3.New(s.(*storage).sess).CreateBucket(
+		&s3.CreateBucketInput{Bucket: aws.String(conf.Bucket)},
+	)
+	if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+		err = nil
+	}
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v, error: %v", conf.Bucket, err)
+	}
+	return s.(*storage)
+}
+
+// TestStorage_conformance run the conformance tests against the S3 compatible service
+func TestStorage_conformance(t *testing.T) {
+	s := newTestStorage(t)
+	storagetest.Run(
+		t, storagetest.Config{Storage: s, LargeFileSize: testBlockSize*2 + 1024, Metadata: true},
+	)
+}
+
+func TestStorage_resume(t *testing.T) {
+	s := newTestStorage(t)
+	path := fmt.Sprintf("/resume-%d", time.Now().UnixNano())
+	defer func() {
+		_ = s.Delete(context.Background(), path)
+	}()
+	data := make([]byte, testBlockSize*3+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	var checkpoint *api.Checkpoint
+	save := func(c *api.Checkpoint) {
+		checkpoint = c
+	}
+
+	// the first attempt fails to read the parts after the second part
+	reader := &failingReaderAt{ReaderAt: bytes.NewReader(data), failAt: testBlockSize * 2}
+	err := s.Upload(
+		context.Background(), path, reader, int64(len(data)), api.WithCheckpoint(nil, save),
+	)
+	if err == nil {
+		t.Fatal("Upload() of failing reader, error = nil")
+	}
+	if checkpoint == nil || len(checkpoint.Parts) != 2 {
+		t.Fatalf("checkpoint = %+v, want 2 parts", checkpoint)
+	}
+	uploadID := checkpoint.UploadID
+
+	// the second part is changed, so it's uploaded again
+	data[testBlockSize+1]++
+	w, err := s.Create(context.Background(), path, api.WithCheckpoint(checkpoint, save))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if checkpoint.UploadID != uploadID || len(checkpoint.Parts) != 4 {
+		t.Errorf("checkpoint = %+v, want 4 parts of upload: %v", checkpoint, uploadID)
+	}
+	r, err := s.Get(context.Background(), path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content of resumed upload has %v bytes, want %v bytes", len(got), len(data))
+	}
+}
+
+func TestStorage_resume_cancel(t *testing.T) {
+	s, fake := newFakeStorage(t)
+	data := make([]byte, testBlockSize*3+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	mutex := sync.Mutex{}
+	var checkpoint *api.Checkpoint
+	save := func(c *api.Checkpoint) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		checkpoint = c
+	}
+	saved := func() *api.Checkpoint {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return checkpoint
+	}
+
+	// the first attempt is canceled after two parts, the upload is kept for resuming
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := s.Create(ctx, "/a", api.WithCheckpoint(nil, save))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = w.Write(data[:testBlockSize*2+1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for c := saved(); c == nil || len(c.Parts) < 2; c = saved() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err = w.Close(); err == nil {
+		t.Fatal("Close() after cancel, error = nil")
+	}
+	if uploads := fake.Uploads(); len(uploads) != 1 || uploads[0] != saved().UploadID {
+		t.Fatalf("uploads = %v, want upload of the checkpoint", uploads)
+	}
+
+	fake.Operations()
+	w, err = s.Create(context.Background(), "/a", api.WithCheckpoint(saved(), save))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "[ListParts UploadPart UploadPart CompleteMultipartUpload]"
+	if got := fmt.Sprint(fake.Operations()); got != want {
+		t.Errorf("operations of resumed upload = %v, want %v", got, want)
+	}
+	r, err := s.Get(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content of resumed upload has %v bytes, want %v bytes", len(got), len(data))
+	}
+}
+
+func TestStorage_resume_stale(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkpoint api.Checkpoint
+		sha256     string
+	}{
+		{name: "part size", checkpoint: api.Checkpoint{PartSize: testBlockSize * 2}},
+		{
+			name:       "content",
+			checkpoint: api.Checkpoint{PartSize: testBlockSize, SHA256: "old"},
+			sha256:     "new",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				s, fake := newFakeStorage(t)
+				upload, err := fake.CreateMultipartUploadWithContext(
+					context.Background(), &s3.CreateMultipartUploadInput{
+						Bucket: aws.String(s.bucket), Key: aws.String("/a"),
+					},
+				)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				checkpoint := tt.checkpoint
+				checkpoint.UploadID = aws.StringValue(upload.UploadId)
+				w, err := s.Create(
+					context.Background(), "/a", api.WithSHA256(tt.sha256),
+					api.WithCheckpoint(&checkpoint, func(*api.Checkpoint) {}),
+				)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				_, err = w.Write(make([]byte, testBlockSize*2+1))
+				if err == nil {
+					err = w.Close()
+				}
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if uploads := fake.Uploads(); len(uploads) != 0 {
+					t.Errorf("uploads = %v, want the stale upload aborted", uploads)
+				}
+				// the upload is gone, aborting it again succeeds
+				err = s.AbortCheckpoint(context.Background(), "/a", &checkpoint)
+				if err != nil {
+					t.Errorf("AbortCheckpoint() of aborted upload, error = %v", err)
+				}
+			},
+		)
+	}
+}
+
+func TestStorage_AbortUploads(t *testing.T) {
+	s, fake := newFakeStorage(t)
+	ctx := context.Background()
+	// the writer in progress is kept, uploads of crashed processes are aborted
+	w, err := s.Create(ctx, "/a/writing")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := make([]byte, testBlockSize+1)
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var orphans []string
+	for _, key := range []string{"/a/orphan", "/a/other"} {
+		upload, err := fake.CreateMultipartUploadWithContext(
+			ctx, &s3.CreateMultipartUploadInput{
+				Bucket: aws.String(s.bucket), Key: aws.String(key),
+			},
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		orphans = append(orphans, aws.StringValue(upload.UploadId))
+	}
+
+	aborted, err := s.AbortUploads(
+		ctx, "/a/", time.Now().Add(time.Minute), func(path, uploadID string) bool {
+			return uploadID != orphans[1]
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if aborted != 1 {
+		t.Errorf("AbortUploads() = %v, want 1", aborted)
+	}
+	uploads := fake.Uploads()
+	if len(uploads) != 2 || uploads[1] != orphans[1] {
+		t.Fatalf("uploads = %v, want the writer and %v", uploads, orphans[1])
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the upload is released in background after the writer is done
+	deadline := time.Now().Add(5 * time.Second)
+	for s.activeUpload(uploads[0]) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout: the upload of the closed writer is active")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStorage_copyMultipart(t *testing.T) {
+	tests := []struct {
+		name    string
+		copyErr error
+	}{
+		{name: "copy"},
+		{name: "failed", copyErr: fakeError("InternalError", 500)},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				s, fake := newFakeStorage(t)
+				ctx := context.Background()
+				w, err := s.Create(
+					ctx, "/a", api.WithTags(map[string]string{"team": "ops"}),
+					api.WithMetadata(map[string]string{"owner": "fsync"}),
+				)
+				if err == nil {
+					_, err = w.Write([]byte("hello"))
+				}
+				if err == nil {
+					err = w.Close()
+				}
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				head, err := fake.HeadObjectWithContext(
+					ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String("/a")},
+				)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				fake.copyErr = tt.copyErr
+
+				err = s.copyMultipart(ctx, fake, "/a", "/b", head)
+				if tt.copyErr != nil {
+					if err == nil {
+						t.Fatal("copyMultipart() error = nil")
+					}
+					if uploads := fake.Uploads(); len(uploads) != 0 {
+						t.Errorf("uploads = %v, want the failed copy aborted", uploads)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				tags, err := fake.GetObjectTaggingWithContext(
+					ctx, &s3.GetObjectTaggingInput{
+						Bucket: aws.String(s.bucket), Key: aws.String("/b"),
+					},
+				)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if got := tagMap(tags.TagSet); len(got) != 1 || got["team"] != "ops" {
+					t.Errorf("tags of the copy = %v, want team=ops", got)
+				}
+				info, err := s.Info(ctx, "/b")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if info.Size != 5 || info.Metadata["owner"] != "fsync" {
+					t.Errorf("copy = %+v, want the content and metadata of the source", info)
+				}
+			},
+		)
+	}
+}
+
+// limitMemory replace the memory budget of the storage
+func limitMemory(s *storage, limit int64) {
+	s.memoryLimit = limit
+	s.memory = semaphore.NewWeighted(limit)
+}
+
+// partCounter counts the parts and the bytes in flight of the fake S3, and records the max
+type partCounter struct {
+	mutex    sync.Mutex
+	parts    int
+	bytes    int64
+	maxParts int
+	maxBytes int64
+}
+
+// beforePart hold the part in flight for a while
+func (c *partCounter) beforePart(input *s3.UploadPartInput) error {
+	size, err := input.Body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = input.Body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.parts++
+	c.bytes += size
+	if c.parts > c.maxParts {
+		c.maxParts = c.parts
+	}
+	if c.bytes > c.maxBytes {
+		c.maxBytes = c.bytes
+	}
+	c.mutex.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	c.mutex.Lock()
+	c.parts--
+	c.bytes -= size
+	c.mutex.Unlock()
+	return nil
+}
+
+func TestStorage_memory(t *testing.T) {
+	// whole parts only, small tail parts would fit the budget beside the full parts
+	data := make([]byte, testBlockSize*4)
+	rand.New(rand.NewSource(1)).Read(data)
+	tests := []struct {
+		name        string
+		concurrency int
+		memory      int64
+		writers     int
+		wantParts   int
+	}{
+		{name: "concurrency", concurrency: 2, memory: 16 * testBlockSize, writers: 1, wantParts: 2},
+		{name: "memory", concurrency: 4, memory: 2 * testBlockSize, writers: 4, wantParts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				s, fake := newFakeStorage(t)
+				s.concurrency = tt.concurrency
+				limitMemory(s, tt.memory)
+				counter := &partCounter{}
+				fake.beforePart = counter.beforePart
+				wg := sync.WaitGroup{}
+				for i := 0; i < tt.writers; i++ {
+					path := fmt.Sprintf("/file-%d", i)
+					upload := i%2 == 0
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						var err error
+						if upload {
+							err = s.Upload(
+								context.Background(), path, bytes.NewReader(data),
+								int64(len(data)),
+							)
+						} else {
+							var w io.WriteCloser
+							w, err = s.Create(context.Background(), path)
+							if err == nil {
+								_, err = w.Write(data)
+							}
+							if err == nil {
+								err = w.Close()
+							}
+						}
+						if err != nil {
+							t.Error(err.Error())
+						}
+					}()
+				}
+				wg.Wait()
+				if counter.maxParts != tt.wantParts || counter.maxBytes > tt.memory {
+					t.Errorf(
+						"max in-flight parts = %v, bytes = %v, want %v parts within %v bytes",
+						counter.maxParts, counter.maxBytes, tt.wantParts, tt.memory,
+					)
+				}
+				if !s.memory.TryAcquire(tt.memory) {
+					t.Error("memory of the buffers isn't released")
+				}
+			},
+		)
+	}
+}
+
+func TestStorage_streamPart(t *testing.T) {
+	s, fake := newFakeStorage(t)
+	// parts of the reader larger than the budget are streamed
+	limitMemory(s, testBlockSize)
+	data := make([]byte, testBlockSize*4+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w, err := s.create(ctx, "/a", testBlockSize*2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = w.readFrom(bytes.NewReader(data), int64(len(data)))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "[CreateMultipartUpload UploadPart UploadPart UploadPart CompleteMultipartUpload]"
+	if got := fmt.Sprint(fake.Operations()); got != want {
+		t.Errorf("operations = %v, want %v", got, want)
+	}
+	r, err := s.Get(ctx, "/a")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("content of streamed parts has %v bytes, want %v bytes", len(got), len(data))
+	}
+	if !s.memory.TryAcquire(testBlockSize) {
+		t.Error("memory of the buffers isn't released")
+	}
+}
+
+func TestStorage_put(t *testing.T) {
+	s, fake := newFakeStorage(t)
+	root := fmt.Sprintf("/put-%d/", time.Now().UnixNano())
+	defer func() {
+		_ = s.DeleteAll(context.Background(), root)
+	}()
+	multipart := "[CreateMultipartUpload UploadPart UploadPart CompleteMultipartUpload]"
+	tests := []struct {
+		size int
+		want string
+	}{
+		{size: 0, want: "[PutObject]"},
+		{size: 200, want: "[PutObject]"},
+		{size: testBlockSize, want: "[PutObject]"},
+		{size: testBlockSize + 1, want: multipart},
+	}
+	for _, tt := range tests {
+		for _, upload := range []bool{false, true} {
+			name := fmt.Sprintf("%v-%v", tt.size, upload)
+			t.Run(
+				name, func(t *testing.T) {
+					fake.Operations()
+					data := make([]byte, tt.size)
+					var err error
+					if upload {
+						err = s.Upload(
+							context.Background(), root+name, bytes.NewReader(data), int64(tt.size),
+						)
+					} else {
+						var w io.WriteCloser
+						w, err = s.Create(context.Background(), root+name)
+						if err == nil {
+							_, err = w.Write(data)
+						}
+						if err == nil {
+							err = w.Close()
+						}
+					}
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if got := fmt.Sprint(fake.Operations()); got != tt.want {
+						t.Errorf("operations = %v, want %v", got, tt.want)
+					}
+				},
+			)
+		}
+	}
+}
+
+func TestStorage_skipETagCheck(t *testing.T) {
+	root := fmt.Sprintf("/etag-%d/", time.Now().UnixNano())
+	for _, skip := range []bool{false, true} {
+		for _, size := range []int{200, testBlockSize + 1} {
+			name := fmt.Sprintf("%v-%v", size, skip)
+			t.Run(
+				name, func(t *testing.T) {
+					s, fake := newFakeStorage(t)
+					s.skipETagCheck = skip
+					fake.etag = strings.Repeat("0", 32)
+					err := s.Upload(
+						context.Background(), root+name, bytes.NewReader(make([]byte, size)),
+						int64(size),
+					)
+					if (err != nil) == skip {
+						t.Errorf("Upload() error = %v, want error %v", err, !skip)
+					}
+					if err != nil && !errors.Is(err, api.ErrTransient) {
+						t.Errorf("Upload() error = %v, want api.ErrTransient", err)
+					}
+				},
+			)
+		}
+	}
+}
+
+func TestStorage_sha256(t *testing.T) {
+	s := newTestStorage(t)
+	root := fmt.Sprintf("/sha256-%d/", time.Now().UnixNano())
+	defer func() {
+		_ = s.DeleteAll(context.Background(), root)
+	}()
+	data := bytes.Repeat([]byte("a"), testBlockSize+1)
+	sum := sha256.Sum256(data[:200])
+	w, err := s.Create(context.Background(), root+"put")
+	if err == nil {
+		_, err = w.Write(data[:200])
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info, err := s.Info(context.Background(), root+"put")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := hex.EncodeToString(sum[:]); info.SHA256 != want {
+		t.Errorf("SHA256 of put = %v, want %v", info.SHA256, want)
+	}
+
+	sum = sha256.Sum256(data)
+	err = s.Upload(
+		context.Background(), root+"multipart", bytes.NewReader(data), int64(len(data)),
+		api.WithSHA256(hex.EncodeToString(sum[:])),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info, err = s.Info(context.Background(), root+"multipart")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := hex.EncodeToString(sum[:]); info.SHA256 != want {
+		t.Errorf("SHA256 of multipart upload = %v, want %v", info.SHA256, want)
+	}
+}
+
+func Test_checkETag(t *testing.T) {
+	sum := md5.Sum([]byte("a"))
+	etag := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name              string
+		etag              string
+		encryption        string
+		customerAlgorithm string
+		wantErr           bool
+	}{
+		{name: "md5", etag: "\"" + etag + "\""},
+		{name: "different md5", etag: "\"" + strings.Repeat("0", 32) + "\"", wantErr: true},
+		{name: "kms", etag: strings.Repeat("0", 32), encryption: s3.ServerSideEncryptionAwsKms},
+		{name: "not md5", etag: "\"0123\""},
+		{name: "sse-c", etag: strings.Repeat("0", 32), customerAlgorithm: "AES256"},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				err := checkETag(
+					"/a", aws.String(tt.etag), aws.String(tt.encryption),
+					aws.String(tt.customerAlgorithm), sum[:],
+				)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("checkETag() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil && !errors.Is(err, api.ErrTransient) {
+					t.Errorf("checkETag() error = %v, want api.ErrTransient", err)
+				}
+			},
+		)
+	}
+}
+
+func Test_metadata(t *testing.T) {
+	got := metadata(map[string]string{"Owner": "fsync", "sha256": "user"}, "sum")
+	if len(got) != 2 || aws.StringValue(got["owner"]) != "fsync" ||
+		aws.StringValue(got[sha256Metadata]) != "sum" {
+		t.Errorf("metadata() = %v, want lower case keys and the sha256 of the content", got)
+	}
+	if got := metadata(nil, ""); got != nil {
+		t.Errorf("metadata() = %v, want nil", got)
+	}
+	user := userMetadata(
+		map[string]*string{"Owner": aws.String("fsync"), "Sha256": aws.String("sum")},
+	)
+	if len(user) != 1 || user["owner"] != "fsync" {
+		t.Errorf("userMetadata() = %v, want owner only", user)
+	}
+	tags := tagging(map[string]string{"env": "prod", "team": "a&b"})
+	if want := "env=prod&team=a%26b"; aws.StringValue(tags) != want {
+		t.Errorf("tagging() = %v, want %v", aws.StringValue(tags), want)
+	}
+}
+
+// failingReaderAt reader which fails to read at or after the offset
+type failingReaderAt struct {
+	io.ReaderAt
+	failAt int64
+}
+
+func (f *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.failAt {
+		return 0, errors.New("read failed")
+	}
+	return f.ReaderAt.ReadAt(p, off)
+}
+
+func Test_wrap(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{
+			name: "not found", want: api.ErrNotExist,
+			err: awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), 404, "1"),
+		},
+		{
+			name: "access denied", want: api.ErrPermission,
+			err: awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "1"),
+		},
+		{
+			name: "slow down", want: api.ErrThrottled,
+			err: awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "1"),
+		},
+		{
+			name: "precondition", want: api.ErrConflict,
+			err: awserr.NewRequestFailure(awserr.New("PreconditionFailed", "", nil), 412, "1"),
+		},
+		{
+			name: "network", want: api.ErrTransient,
+			err: awserr.New(request.ErrCodeRequestError, "send request failed", nil),
+		},
+		{
+			name: "bad digest", want: api.ErrTransient,
+			err: awserr.NewRequestFailure(awserr.New("BadDigest", "bad digest", nil), 400, "1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				err := wrap("get", "/a", tt.err)
+				if !errors.Is(err, tt.want) {
+					t.Errorf("wrap() = %v, want %v", err, tt.want)
+				}
+				if !errors.Is(err, tt.err) {
+					t.Errorf("wrap() = %v doesn't wrap the native error", err)
+				}
+			},
+		)
+	}
+	if err := wrap("get", "/a", errors.New("unknown")); errors.Is(err, api.ErrTransient) {
+		t.Errorf("wrap() of unknown error = %v", err)
+	}
+}
+
+func Test_ossWriter_nextPartSize(t *testing.T) {
+	const mib = 1024 * 1024
+	unlimited := &storage{memoryLimit: api.MaxPartSize}
+	tests := []struct {
+		partNumber int64
+		growing    bool
+		memory     int64
+		want       int64
+	}{
+		{partNumber: 1, growing: false, want: 5 * mib},
+		{partNumber: 5000, growing: false, want: 5 * mib},
+		{partNumber: 1, growing: true, want: 5 * mib},
+		{partNumber: partGrowth, growing: true, want: 5 * mib},
+		{partNumber: partGrowth + 1, growing: true, want: 10 * mib},
+		{partNumber: api.MaxParts, growing: true, want: 2560 * mib},
+		{partNumber: 20000, growing: true, want: api.MaxPartSize},
+		{partNumber: api.MaxParts, growing: true, memory: 64 * mib, want: 64 * mib},
+	}
+	for _, tt := range tests {
+		o := &ossWriter{
+			s: unlimited, partSize: 5 * mib, partNumber: tt.partNumber, growing: tt.growing,
+		}
+		if tt.memory > 0 {
+			o.s = &storage{memoryLimit: tt.memory}
+		}
+		if got := o.nextPartSize(); got != tt.want {
+			t.Errorf(
+				"nextPartSize() of part: %v growing: %v = %v, want %v", tt.partNumber, tt.growing,
+				got, tt.want,
+			)
+		}
+	}
+	var total int64
+	o := &ossWriter{s: unlimited, partSize: api.MinPartSize, partNumber: 1, growing: true}
+	for ; o.partNumber <= api.MaxParts; o.partNumber++ {
+		total += o.nextPartSize()
+	}
+	if total < 4*1024*1024*mib {
+		t.Errorf("max size of content of unknown size = %v, want at least 4 TiB", total)
+	}
+}
+
+func TestNewOssStorage_blockSize(t *testing.T) {
+	for _, blockSize := range []int64{1024 * 1024, api.MaxPartSize + 1} {
+		_, err := NewOssStorage(&Conf{Endpoint: "http://127.0.0.1:9000"}, int(blockSize), false)
+		if err == nil {
+			t.Errorf("NewOssStorage() of block size: %v, error = nil", blockSize)
+		}
+	}
+}
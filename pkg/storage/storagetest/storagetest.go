@@ -0,0 +1,450 @@
+// Package storagetest conformance tests of api.FileStorage, backends run them against themselves
+// to make sure they share the same semantics:
+//
+//   - files are created by Close of the writer, and overwritten entirely
+//   - missing files return errors which satisfy errors.Is(err, api.ErrNotExist), except Delete
+//     which returns nil
+//   - paths are absolute and slash separated, and listed in lexical order
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pjoc-team/fsync/pkg/storage/api"
+)
+
+const (
+	// defaultLargeFileSize default size of the large file
+	defaultLargeFileSize = 16 * 1024 * 1024
+	// writeChunkSize size of writes, which isn't aligned to parts
+	writeChunkSize = 100*1024 + 7
+)
+
+// Config config of the conformance tests
+type Config struct {
+	// Storage storage under test, every test writes under its own directory and removes it
+	Storage api.FileStorage
+	// LargeFileSize size of the large file, it should be larger than several parts of multipart
+	// backends, defaultLargeFileSize is used if it's not positive
+	LargeFileSize int64
+	// Metadata the storage keeps the content type and the user metadata of the options
+	Metadata bool
+}
+
+// Run run the conformance tests of the storage
+func Run(t *testing.T, c Config) {
+	if c.LargeFileSize <= 0 {
+		c.LargeFileSize = defaultLargeFileSize
+	}
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, c Config, root string)
+	}{
+		{name: "RoundTrip", fn: testRoundTrip},
+		{name: "NestedPath", fn: testNestedPath},
+		{name: "EmptyFile", fn: testEmptyFile},
+		{name: "LargeFile", fn: testLargeFile},
+		{name: "Overwrite", fn: testOverwrite},
+		{name: "Missing", fn: testMissing},
+		{name: "CopyMove", fn: testCopyMove},
+		{name: "List", fn: testList},
+		{name: "DeleteAll", fn: testDeleteAll},
+		{name: "ConcurrentWriters", fn: testConcurrentWriters},
+		{name: "Abort", fn: testAbort},
+		{name: "Upload", fn: testUpload},
+		{name: "Metadata", fn: testMetadata},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(
+			tt.name, func(t *testing.T) {
+				root := fmt.Sprintf("/storagetest-%d/%s/", time.Now().UnixNano(), tt.name)
+				defer func() {
+					_ = c.Storage.DeleteAll(context.Background(), root)
+				}()
+				tt.fn(t, c, root)
+			},
+		)
+	}
+}
+
+func write(t *testing.T, s api.FileStorage, path string, data []byte) {
+	t.Helper()
+	err := writeFile(s, path, data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// writeFile write the data in chunks
+func writeFile(s api.FileStorage, path string, data []byte) error {
+	w, err := s.Create(context.Background(), path)
+	if err != nil {
+		return fmt.Errorf("Create(%v) error = %v", path, err)
+	}
+	for len(data) > 0 {
+		n := writeChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = w.Write(data[:n])
+		if err != nil {
+			_ = w.Close()
+			return fmt.Errorf("Write(%v) error = %v", path, err)
+		}
+		data = data[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("Close(%v) error = %v", path, err)
+	}
+	return nil
+}
+
+func read(t *testing.T, s api.FileStorage, path string) []byte {
+	t.Helper()
+	r, err := s.Get(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Get(%v) error = %v", path, err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %v error = %v", path, err)
+	}
+	return data
+}
+
+// assertFile assert the content and the info of the file
+func assertFile(t *testing.T, s api.FileStorage, path string, want []byte) {
+	t.Helper()
+	if got := read(t, s, path); !bytes.Equal(got, want) {
+		t.Errorf("content of %v has %v bytes, want %v bytes", path, len(got), len(want))
+	}
+	info, err := s.Info(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Info(%v) error = %v", path, err)
+	}
+	if info.Path != path || info.Size != int64(len(want)) || info.ModTime.IsZero() {
+		t.Errorf("Info(%v) = %+v, want size %v", path, info, len(want))
+	}
+	if info.ETag == "" || info.StorageClass == "" {
+		t.Errorf("Info(%v) = %+v, want etag and storage class", path, info)
+	}
+}
+
+// assertMissing assert the error is returned for a missing file
+func assertMissing(t *testing.T, op string, err error) {
+	t.Helper()
+	if !errors.Is(err, api.ErrNotExist) {
+		t.Errorf("%v of missing file, error = %v, want api.ErrNotExist", op, err)
+	}
+}
+
+// list returns the paths of all files of the prefix
+func list(t *testing.T, s api.FileStorage, prefix string) []string {
+	t.Helper()
+	paths := make([]string, 0)
+	err := api.Walk(
+		context.Background(), s, prefix, func(info *api.FileInfo) error {
+			paths = append(paths, info.Path)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("Walk(%v) error = %v", prefix, err)
+	}
+	return paths
+}
+
+func assertPaths(t *testing.T, op string, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%v = %v, want %v", op, got, want)
+	}
+}
+
+func randomBytes(n int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(n)).Read(data)
+	return data
+}
+
+func testRoundTrip(t *testing.T, c Config, root string) {
+	path := root + "file.txt"
+	write(t, c.Storage, path, []byte("hello fsync"))
+	assertFile(t, c.Storage, path, []byte("hello fsync"))
+	info, err := c.Storage.Info(context.Background(), path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info.FileName != "file.txt" {
+		t.Errorf("FileName = %v, want file.txt", info.FileName)
+	}
+}
+
+func testNestedPath(t *testing.T, c Config, root string) {
+	path := root + "a/b/c/file.txt"
+	write(t, c.Storage, path, []byte("nested"))
+	assertFile(t, c.Storage, path, []byte("nested"))
+	assertPaths(t, "list", list(t, c.Storage, root), path)
+}
+
+func testEmptyFile(t *testing.T, c Config, root string) {
+	path := root + "empty"
+	write(t, c.Storage, path, nil)
+	assertFile(t, c.Storage, path, []byte{})
+}
+
+func testLargeFile(t *testing.T, c Config, root string) {
+	path := root + "large"
+	data := randomBytes(c.LargeFileSize)
+	write(t, c.Storage, path, data)
+	assertFile(t, c.Storage, path, data)
+}
+
+func testOverwrite(t *testing.T, c Config, root string) {
+	path := root + "file.txt"
+	write(t, c.Storage, path, []byte("the first and longer content"))
+	write(t, c.Storage, path, []byte("second"))
+	assertFile(t, c.Storage, path, []byte("second"))
+}
+
+func testMissing(t *testing.T, c Config, root string) {
+	ctx := context.Background()
+	path := root + "missing"
+	_, err := c.Storage.Get(ctx, path)
+	assertMissing(t, "Get", err)
+	_, err = c.Storage.Info(ctx, path)
+	assertMissing(t, "Info", err)
+	assertMissing(t, "Copy", c.Storage.Copy(ctx, path, root+"copied"))
+	assertMissing(t, "Move", c.Storage.Move(ctx, path, root+"moved"))
+	err = c.Storage.Delete(ctx, path)
+	if err != nil {
+		t.Errorf("Delete of missing file, error = %v", err)
+	}
+	assertPaths(t, "list", list(t, c.Storage, root))
+}
+
+func testCopyMove(t *testing.T, c Config, root string) {
+	ctx := context.Background()
+	src := root + "src.txt"
+	write(t, c.Storage, src, []byte("content"))
+	err := c.Storage.Copy(ctx, src, root+"dir/copied.txt")
+	if err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	err = c.Storage.Move(ctx, src, root+"moved.txt")
+	if err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	assertFile(t, c.Storage, root+"dir/copied.txt", []byte("content"))
+	assertFile(t, c.Storage, root+"moved.txt", []byte("content"))
+	_, err = c.Storage.Info(ctx, src)
+	assertMissing(t, "Info of moved file", err)
+}
+
+func testList(t *testing.T, c Config, root string) {
+	ctx := context.Background()
+	paths := []string{root + "a/1", root + "a/2", root + "a1", root + "a2/1", root + "b/1"}
+	for i := len(paths) - 1; i >= 0; i-- {
+		write(t, c.Storage, paths[i], []byte(paths[i]))
+	}
+	assertPaths(t, "list", list(t, c.Storage, root), paths...)
+	assertPaths(t, "list of prefix a", list(t, c.Storage, root+"a"), paths[:4]...)
+	assertPaths(t, "list of dir a", list(t, c.Storage, root+"a/"), paths[:2]...)
+	assertPaths(t, "list of missing prefix", list(t, c.Storage, root+"c"))
+
+	result, err := c.Storage.List(ctx, root, &api.ListOptions{MaxKeys: 2})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(result.Files) != 2 || result.NextToken == "" {
+		t.Fatalf("List() of 2 keys = %v files, next token: %v", len(result.Files), result.NextToken)
+	}
+	info := result.Files[1]
+	if info.Path != paths[1] || info.Size != int64(len(paths[1])) || info.ModTime.IsZero() {
+		t.Errorf("List() file = %+v", info)
+	}
+	// list results carry the same etag as Info, which is compared by restores
+	stat, err := c.Storage.Info(ctx, info.Path)
+	if err != nil {
+		t.Fatalf("Info() error = %v", err)
+	}
+	if info.ETag == "" || info.ETag != stat.ETag {
+		t.Errorf("List() etag = %v, want %v", info.ETag, stat.ETag)
+	}
+
+	// names sorted before and after "/" resume from the token of every page
+	sorted := []string{root + "c/a-1", root + "c/a.txt", root + "c/a/1", root + "c/a0/1"}
+	for _, path := range sorted {
+		write(t, c.Storage, path, []byte(path))
+	}
+	got := make([]string, 0)
+	opts := &api.ListOptions{MaxKeys: 1}
+	for {
+		result, err := c.Storage.List(ctx, root+"c/", opts)
+		if err != nil {
+			t.Fatalf("List() error = %v", err)
+		}
+		for _, info := range result.Files {
+			got = append(got, info.Path)
+		}
+		if result.NextToken == "" {
+			break
+		}
+		opts = &api.ListOptions{Token: result.NextToken, MaxKeys: 1}
+	}
+	assertPaths(t, "list of pages", got, sorted...)
+}
+
+func testDeleteAll(t *testing.T, c Config, root string) {
+	ctx := context.Background()
+	for _, path := range []string{"dir/1", "dir/sub/2", "dir2/3", "dir.txt"} {
+		write(t, c.Storage, root+path, []byte(path))
+	}
+	err := c.Storage.DeleteAll(ctx, root+"dir")
+	if err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	assertPaths(t, "list", list(t, c.Storage, root), root+"dir.txt", root+"dir2/3")
+	err = c.Storage.DeleteAll(ctx, root+"missing/")
+	if err != nil {
+		t.Errorf("DeleteAll() of missing dir, error = %v", err)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, c Config, root string) {
+	const writers = 8
+	shared := root + "shared"
+	contents := make([][]byte, writers)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, writeChunkSize*2+i)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := writeFile(c.Storage, fmt.Sprintf("%sfile-%d", root, i), contents[i])
+			if err != nil {
+				t.Error(err.Error())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := writeFile(c.Storage, shared, contents[i])
+			if err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for i := 0; i < writers; i++ {
+		assertFile(t, c.Storage, fmt.Sprintf("%sfile-%d", root, i), contents[i])
+	}
+	got := read(t, c.Storage, shared)
+	for _, content := range contents {
+		if bytes.Equal(got, content) {
+			return
+		}
+	}
+	t.Errorf("content of %v is mixed by the writers", shared)
+}
+
+func testAbort(t *testing.T, c Config, root string) {
+	path := root + "file.txt"
+	write(t, c.Storage, path, []byte("content"))
+	for _, p := range []string{path, root + "new.txt"} {
+		w, err := c.Storage.Create(context.Background(), p)
+		if err != nil {
+			t.Fatalf("Create(%v) error = %v", p, err)
+		}
+		aborter, ok := w.(api.Aborter)
+		if !ok {
+			_ = w.Close()
+			t.Skip("writer doesn't support abort")
+		}
+		_, err = w.Write(randomBytes(writeChunkSize))
+		if err != nil {
+			t.Fatalf("Write(%v) error = %v", p, err)
+		}
+		err = aborter.Abort()
+		if err != nil {
+			t.Fatalf("Abort(%v) error = %v", p, err)
+		}
+	}
+	assertFile(t, c.Storage, path, []byte("content"))
+	assertPaths(t, "list", list(t, c.Storage, root), path)
+}
+
+func testUpload(t *testing.T, c Config, root string) {
+	uploader, ok := c.Storage.(api.Uploader)
+	if !ok {
+		t.Skip("storage doesn't support upload")
+	}
+	for _, size := range []int64{0, 1024, c.LargeFileSize} {
+		path := fmt.Sprintf("%sfile-%d", root, size)
+		data := randomBytes(size)
+		err := uploader.Upload(context.Background(), path, bytes.NewReader(data), size)
+		if err != nil {
+			t.Fatalf("Upload(%v) error = %v", path, err)
+		}
+		assertFile(t, c.Storage, path, data)
+	}
+}
+
+func testMetadata(t *testing.T, c Config, root string) {
+	if !c.Metadata {
+		t.Skip("storage doesn't support metadata")
+	}
+	for _, size := range []int64{1024, c.LargeFileSize} {
+		path := fmt.Sprintf("%sfile-%d", root, size)
+		w, err := c.Storage.Create(
+			context.Background(), path, api.WithMimetype("text/plain"),
+			api.WithMetadata(map[string]string{"Owner": "fsync"}),
+		)
+		if err != nil {
+			t.Fatalf("Create(%v) error = %v", path, err)
+		}
+		_, err = w.Write(randomBytes(size))
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("Write(%v) error = %v", path, err)
+		}
+		copied := path + ".copy"
+		err = c.Storage.Copy(context.Background(), path, copied)
+		if err != nil {
+			t.Fatalf("Copy(%v) error = %v", path, err)
+		}
+		for _, p := range []string{path, copied} {
+			info, err := c.Storage.Info(context.Background(), p)
+			if err != nil {
+				t.Fatalf("Info(%v) error = %v", p, err)
+			}
+			if info.ContentType != "text/plain" || info.Metadata["owner"] != "fsync" {
+				t.Errorf(
+					"Info(%v) content type = %v, metadata = %v, want text/plain and owner",
+					p, info.ContentType, info.Metadata,
+				)
+			}
+		}
+	}
+}